@@ -0,0 +1,52 @@
+package dmsg
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptLimiter limits the rate at which remotely-initiated transports are accepted (see SetAcceptRateLimit).
+// It is a token bucket which refills at 'rate' tokens per second, and holds at most 'burst' tokens.
+// A nil acceptLimiter allows everything.
+type acceptLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mx     sync.Mutex
+}
+
+func newAcceptLimiter(rate float64, burst int) *acceptLimiter {
+	return &acceptLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow consumes a token and returns true if one is available.
+func (l *acceptLimiter) Allow() bool {
+	return l.allow(time.Now())
+}
+
+func (l *acceptLimiter) allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,39 @@
+package dmsg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptLimiter(t *testing.T) {
+	t.Run("Nil limiter allows everything", func(t *testing.T) {
+		var l *acceptLimiter
+		for i := 0; i < 10; i++ {
+			assert.True(t, l.Allow())
+		}
+	})
+
+	t.Run("Burst then refill", func(t *testing.T) {
+		l := newAcceptLimiter(2, 3)
+		now := l.last
+
+		for i := 0; i < 3; i++ {
+			assert.True(t, l.allow(now), i)
+		}
+		assert.False(t, l.allow(now))
+
+		// 2 tokens per second: one token is refilled after half a second.
+		now = now.Add(time.Millisecond * 500)
+		assert.True(t, l.allow(now))
+		assert.False(t, l.allow(now))
+
+		// tokens do not exceed the burst.
+		now = now.Add(time.Minute)
+		for i := 0; i < 3; i++ {
+			assert.True(t, l.allow(now), i)
+		}
+		assert.False(t, l.allow(now))
+	})
+}
@@ -0,0 +1,133 @@
+package dmsg
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// captureBufCap is the number of captured frames which can be pending to be written to the capture's writer.
+// Frames captured while the buffer is full are dropped.
+const captureBufCap = 1024
+
+// captureHeaderLen is the length of the header of a capture record:
+// direction(1 byte), timestamp(8 bytes), frameLen(4 bytes).
+const captureHeaderLen = 13
+
+// CaptureDirection represents whether a captured frame was read or written.
+type CaptureDirection byte
+
+// Capture directions.
+const (
+	CaptureIn  = CaptureDirection(0x1)
+	CaptureOut = CaptureDirection(0x2)
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureIn:
+		return "IN"
+	case CaptureOut:
+		return "OUT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// CapturedFrame is a frame record written by a frame capture (see SetFrameCapture).
+type CapturedFrame struct {
+	Direction CaptureDirection
+	Time      time.Time
+	Frame     Frame
+}
+
+// ReadCapturedFrame reads a single record written by a frame capture.
+// A record has the following format:
+//
+//	| Direction | Timestamp (unix nano) | FrameLen | Frame   |
+//	| 1 byte    | 8 bytes               | 4 bytes  | ~ bytes |
+func ReadCapturedFrame(r io.Reader) (CapturedFrame, error) {
+	h := make([]byte, captureHeaderLen)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return CapturedFrame{}, err
+	}
+	f := make(Frame, binary.BigEndian.Uint32(h[9:13]))
+	if _, err := io.ReadFull(r, f); err != nil {
+		return CapturedFrame{}, err
+	}
+	return CapturedFrame{
+		Direction: CaptureDirection(h[0]),
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(h[1:9]))),
+		Frame:     f,
+	}, nil
+}
+
+// frameCapture writes records of captured frames to a writer.
+// Writing is done in a separate goroutine so that capturing never blocks the data path.
+type frameCapture struct {
+	w       io.Writer
+	ch      chan []byte
+	dropped uint64
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newFrameCapture(w io.Writer) *frameCapture {
+	fc := &frameCapture{
+		w:    w,
+		ch:   make(chan []byte, captureBufCap),
+		done: make(chan struct{}),
+	}
+	go fc.serve()
+	return fc
+}
+
+func (fc *frameCapture) serve() {
+	for {
+		select {
+		case <-fc.done:
+			return
+		case rec := <-fc.ch:
+			if _, err := fc.w.Write(rec); err != nil {
+				log.WithError(err).Warn("Failed to write captured frame")
+				atomic.AddUint64(&fc.dropped, 1)
+			}
+		}
+	}
+}
+
+// capture records a copy of the given frame. It is a no-op on a nil frameCapture.
+func (fc *frameCapture) capture(dir CaptureDirection, f Frame) {
+	if fc == nil {
+		return
+	}
+	rec := make([]byte, captureHeaderLen+len(f))
+	rec[0] = byte(dir)
+	binary.BigEndian.PutUint64(rec[1:9], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(rec[9:13], uint32(len(f)))
+	copy(rec[captureHeaderLen:], f)
+
+	select {
+	case fc.ch <- rec:
+	default:
+		atomic.AddUint64(&fc.dropped, 1)
+	}
+}
+
+// Dropped returns the number of captured frames which failed to be written.
+func (fc *frameCapture) Dropped() uint64 {
+	if fc == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&fc.dropped)
+}
+
+func (fc *frameCapture) close() {
+	if fc == nil {
+		return
+	}
+	fc.once.Do(func() { close(fc.done) })
+}
@@ -0,0 +1,70 @@
+package dmsg
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameCapture(t *testing.T) {
+	pr, pw := io.Pipe()
+	fc := newFrameCapture(pw)
+	defer fc.close()
+
+	p1, p2 := net.Pipe()
+	conn := &observedConn{Conn: p1, observe: func(f Frame) { fc.capture(CaptureOut, f) }}
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, p2) // nolint:errcheck
+	}()
+	defer func() {
+		require.NoError(t, p1.Close())
+		require.NoError(t, p2.Close())
+	}()
+
+	f1 := MakeFrame(FwdType, 2, []byte{0x00, 0x01, 0x02})
+	f2 := MakeFrame(AckType, 2, []byte{0x00, 0x01})
+	f3 := MakeFrame(CloseType, 3, []byte{PlaceholderReason})
+
+	// Written frames are captured, even when multiple frames are written at once.
+	_, err := conn.Write(append(append(Frame{}, f1...), f2...))
+	require.NoError(t, err)
+	fc.capture(CaptureIn, f3)
+
+	for _, want := range []CapturedFrame{
+		{Direction: CaptureOut, Frame: f1},
+		{Direction: CaptureOut, Frame: f2},
+		{Direction: CaptureIn, Frame: f3},
+	} {
+		got, err := ReadCapturedFrame(pr)
+		require.NoError(t, err)
+		assert.Equal(t, want.Direction, got.Direction)
+		assert.Equal(t, want.Frame, got.Frame)
+		assert.False(t, got.Time.IsZero())
+	}
+	assert.Equal(t, uint64(0), fc.Dropped())
+}
+
+func TestFrameCapture_Dropped(t *testing.T) {
+	pr, pw := io.Pipe() // writes block as there is no reader
+	fc := newFrameCapture(pw)
+	defer func() {
+		fc.close()
+		require.NoError(t, pr.Close())
+	}()
+
+	f := MakeFrame(FwdType, 2, []byte{0x00, 0x01})
+	for i := 0; i < captureBufCap+2; i++ {
+		fc.capture(CaptureOut, f)
+	}
+	assert.True(t, fc.Dropped() > 0)
+
+	// A nil frameCapture should be usable.
+	var nilFC *frameCapture
+	nilFC.capture(CaptureOut, f)
+	assert.Equal(t, uint64(0), nilFC.Dropped())
+	nilFC.close()
+}
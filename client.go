@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -18,7 +19,8 @@ import (
 var log = logging.MustGetLogger("dmsg")
 
 const (
-	clientReconnectInterval = 3 * time.Second
+	clientReconnectInterval    = 3 * time.Second
+	clientMaxReconnectInterval = time.Minute
 )
 
 var (
@@ -44,10 +46,144 @@ func SetLogger(log *logging.Logger) ClientOption {
 	}
 }
 
+// SetFrameCapture enables capturing of all frames read and written on the Client's connections with dmsg servers.
+// A record of each frame is written to 'w' in the format read by ReadCapturedFrame.
+// Writing is done asynchronously: records are dropped (and counted, see CapturedFramesDropped) if 'w' is too slow.
+func SetFrameCapture(w io.Writer) ClientOption {
+	return func(c *Client) error {
+		if w == nil {
+			return errors.New("nil capture writer set")
+		}
+		c.capture = newFrameCapture(w)
+		return nil
+	}
+}
+
+// SetReconnectBackoff sets the interval before the first attempt to reconnect to a dms_server, and the maximum
+// interval between attempts. The interval doubles after each failed attempt.
+func SetReconnectBackoff(initial, max time.Duration) ClientOption {
+	return func(c *Client) error {
+		if initial <= 0 || max < initial {
+			return errors.New("invalid reconnect backoff set")
+		}
+		c.reconnectMin = initial
+		c.reconnectMax = max
+		return nil
+	}
+}
+
+// SetMaxConcurrentReconnects limits the number of concurrent attempts to reconnect to dms_servers.
+// This avoids many connections being re-established at once with a recovering dms_server.
+// A limit of 0 means no limit.
+func SetMaxConcurrentReconnects(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.New("negative reconnect limit set")
+		}
+		c.reconnectSem = nil
+		if n > 0 {
+			c.reconnectSem = make(chan struct{}, n)
+		}
+		return nil
+	}
+}
+
+// SetConnCallback sets a function which is called whenever a connection with a dms_server is established
+// ('connected' is true) or lost ('connected' is false).
+func SetConnCallback(fn func(srvPK cipher.PubKey, connected bool)) ClientOption {
+	return func(c *Client) error {
+		if fn == nil {
+			return errors.New("nil conn callback set")
+		}
+		c.connCallback = fn
+		return nil
+	}
+}
+
+// SetConnBufferLimit limits the total size of data buffered within the transports of each connection with a
+// dms_server. Once the limit is reached, received data is no longer acknowledged until buffered data is read.
+// A limit of 0 (the default) means no limit.
+func SetConnBufferLimit(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.New("negative conn buffer limit set")
+		}
+		c.connBufMax = n
+		return nil
+	}
+}
+
+// SetConnReadBufferSize sets the size of the buffer used for reading frames from each connection with a
+// dms_server. Buffering reduces the number of reads performed on the underlying connection when many small
+// frames are received. A size of 0 (the default) means reads are unbuffered.
+func SetConnReadBufferSize(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.New("negative conn read buffer size set")
+		}
+		c.connReadBuf = n
+		return nil
+	}
+}
+
+// SetAcceptRateLimit limits the rate at which remotely-initiated transports are accepted, across all
+// connections with dms_servers, to 'rate' transports per second with bursts of up to 'burst' transports.
+// Transports exceeding the limit are refused with ErrClientAcceptMaxed, which the remote may retry.
+// This protects a recovering client from a storm of reconnecting peers. The default is unlimited.
+func SetAcceptRateLimit(rate float64, burst int) ClientOption {
+	return func(c *Client) error {
+		if rate <= 0 || burst <= 0 {
+			return errors.New("non-positive accept rate limit set")
+		}
+		c.acceptLim = newAcceptLimiter(rate, burst)
+		return nil
+	}
+}
+
+// SetMaxTransportsPerRemote limits the number of open remotely-initiated transports which a single remote client
+// can have via each connection with a dms_server, so that a single remote can not monopolize resources.
+// Transports exceeding the limit are refused with ErrRemoteTpsMaxed. A limit of 0 (the default) means no limit.
+func SetMaxTransportsPerRemote(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.New("negative max transports per remote set")
+		}
+		c.maxRemoteTps = n
+		return nil
+	}
+}
+
+// SetMaxListeners limits the number of open listeners of the client (see Listen), to prevent a single client
+// from taking up the port range. Listen returns ErrPortQuotaExceeded once the limit is reached.
+// A limit of 0 (the default) means no limit.
+func SetMaxListeners(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.New("negative max listeners set")
+		}
+		c.pm.setMaxListeners(n)
+		return nil
+	}
+}
+
+// SetUnknownFrameHandler sets how frames of unknown types, which are received for transports, are handled.
+// The default is RejectUnknownFrames. IgnoreUnknownFrames can be used for forward-compatibility with newer peers.
+func SetUnknownFrameHandler(h UnknownFrameHandler) ClientOption {
+	return func(c *Client) error {
+		if h == nil {
+			return errors.New("nil unknown frame handler set")
+		}
+		c.unknownFrame = h
+		return nil
+	}
+}
+
 // Client implements transport.Factory
 type Client struct {
 	log *logging.Logger
 
+	capture *frameCapture
+
 	pk cipher.PubKey
 	sk cipher.SecKey
 	dc disc.APIClient
@@ -57,6 +193,16 @@ type Client struct {
 
 	pm *PortManager
 
+	reconnectMin time.Duration // interval before the first reconnection attempt
+	reconnectMax time.Duration // maximum interval between reconnection attempts
+	reconnectSem chan struct{} // limits concurrent reconnection attempts (nil if unlimited)
+	connCallback func(srvPK cipher.PubKey, connected bool)
+	connBufMax   int // limit of data buffered within the transports of each connection (0 means no limit)
+	connReadBuf  int // size of the read buffer of each connection (0 means unbuffered)
+	unknownFrame UnknownFrameHandler
+	acceptLim    *acceptLimiter // limits the rate of accepted transports (nil if unlimited)
+	maxRemoteTps int            // maximum number of accepted transports per remote client (0 means no limit)
+
 	// accept map[uint16]chan *transport
 	done chan struct{}
 	once sync.Once
@@ -65,12 +211,14 @@ type Client struct {
 // NewClient creates a new Client.
 func NewClient(pk cipher.PubKey, sk cipher.SecKey, dc disc.APIClient, opts ...ClientOption) *Client {
 	c := &Client{
-		log:   logging.MustGetLogger("dmsg_client"),
-		pk:    pk,
-		sk:    sk,
-		dc:    dc,
-		conns: make(map[cipher.PubKey]*ClientConn),
-		pm:    newPortManager(),
+		log:          logging.MustGetLogger("dmsg_client"),
+		pk:           pk,
+		sk:           sk,
+		dc:           dc,
+		conns:        make(map[cipher.PubKey]*ClientConn),
+		pm:           newPortManager(),
+		reconnectMin: clientReconnectInterval,
+		reconnectMax: clientMaxReconnectInterval,
 		// accept: make(chan *transport, AcceptBufferSize),
 		// accept: make(map[uint16]chan *transport),
 		done: make(chan struct{}),
@@ -108,6 +256,10 @@ func (c *Client) setConn(ctx context.Context, conn *ClientConn) {
 		c.log.WithError(err).Warn("updateEntry: failed")
 	}
 	c.mx.Unlock()
+
+	if c.connCallback != nil {
+		c.connCallback(conn.remoteSrv, true)
+	}
 }
 
 func (c *Client) delConn(ctx context.Context, pk cipher.PubKey) {
@@ -117,6 +269,10 @@ func (c *Client) delConn(ctx context.Context, pk cipher.PubKey) {
 		c.log.WithError(err).Warn("updateEntry: failed")
 	}
 	c.mx.Unlock()
+
+	if c.connCallback != nil {
+		c.connCallback(pk, false)
+	}
 }
 
 func (c *Client) getConn(pk cipher.PubKey) (*ClientConn, bool) {
@@ -126,6 +282,17 @@ func (c *Client) getConn(pk cipher.PubKey) (*ClientConn, bool) {
 	return l, ok
 }
 
+// Conns returns a snapshot of the Client's current connections with dms_servers.
+func (c *Client) Conns() []ClientConnInfo {
+	c.mx.RLock()
+	infos := make([]ClientConnInfo, 0, len(c.conns))
+	for _, conn := range c.conns {
+		infos = append(infos, conn.Info())
+	}
+	c.mx.RUnlock()
+	return infos
+}
+
 func (c *Client) connCount() int {
 	c.mx.RLock()
 	n := len(c.conns)
@@ -214,6 +381,12 @@ func (c *Client) findOrConnectToServer(ctx context.Context, srvPK cipher.PubKey)
 	}
 
 	conn := NewClientConn(c.log, nc, c.pk, srvPK, c.pm)
+	conn.setCapture(c.capture)
+	conn.setBufferLimit(c.connBufMax)
+	conn.setReadBufferSize(c.connReadBuf)
+	conn.setUnknownFrameHandler(c.unknownFrame)
+	conn.setAcceptLimiter(c.acceptLim)
+	conn.setMaxRemoteTps(c.maxRemoteTps)
 	if err := conn.readOK(); err != nil {
 		return nil, err
 	}
@@ -224,34 +397,76 @@ func (c *Client) findOrConnectToServer(ctx context.Context, srvPK cipher.PubKey)
 		err := conn.Serve(ctx)
 		conn.log.WithError(err).WithField("remoteServer", srvPK).Warn("connected with server closed")
 		c.delConn(ctx, srvPK)
+		c.reconnect(ctx, srvPK)
+	}()
+	return conn, nil
+}
 
-		// reconnect logic.
-	retryServerConnect:
+// reconnect attempts to re-establish a lost connection with a dms_server, with exponential backoff.
+// A successful reconnection also updates the client's entry in discovery (via setConn).
+func (c *Client) reconnect(ctx context.Context, srvPK cipher.PubKey) {
+	log := c.log.WithField("remoteServer", srvPK)
+
+	for interval := c.reconnectMin; ; interval = nextReconnectInterval(interval, c.reconnectMax) {
 		select {
 		case <-c.done:
+			return
 		case <-ctx.Done():
-		case <-time.After(clientReconnectInterval):
-			conn.log.WithField("remoteServer", srvPK).Warn("Reconnecting")
-			if _, err := c.findOrConnectToServer(ctx, srvPK); err != nil {
-				conn.log.WithError(err).WithField("remoteServer", srvPK).Warn("ReconnectionFailed")
-				goto retryServerConnect
-			}
-			conn.log.WithField("remoteServer", srvPK).Warn("ReconnectionSucceeded")
+			return
+		case <-time.After(interval):
 		}
-	}()
-	return conn, nil
+
+		if !c.acquireReconnect(ctx) {
+			return
+		}
+		log.Warn("Reconnecting")
+		_, err := c.findOrConnectToServer(ctx, srvPK)
+		c.releaseReconnect()
+
+		if err != nil {
+			log.WithError(err).Warn("ReconnectionFailed")
+			continue
+		}
+		log.Warn("ReconnectionSucceeded")
+		return
+	}
+}
+
+func nextReconnectInterval(interval, max time.Duration) time.Duration {
+	if interval *= 2; interval > max {
+		return max
+	}
+	return interval
+}
+
+func (c *Client) acquireReconnect(ctx context.Context) bool {
+	if c.reconnectSem == nil {
+		return true
+	}
+	select {
+	case <-c.done:
+		return false
+	case <-ctx.Done():
+		return false
+	case c.reconnectSem <- struct{}{}:
+		return true
+	}
+}
+
+func (c *Client) releaseReconnect() {
+	if c.reconnectSem != nil {
+		<-c.reconnectSem
+	}
 }
 
 // Listen creates a listener on a given port, adds it to port manager and returns the listener.
 func (c *Client) Listen(port uint16) (*Listener, error) {
-	l, ok := c.pm.NewListener(c.pk, port)
-	if !ok {
-		return nil, errors.New("port is busy")
-	}
-	return l, nil
+	return c.pm.AddListener(c.pk, port)
 }
 
 // Dial dials a transport to remote dms_client.
+// Dialing via each of the remote's delegated servers is attempted in turn, until the transport is established
+// or the dial fails with a permanent error (see IsTemporary).
 func (c *Client) Dial(ctx context.Context, remote cipher.PubKey, port uint16) (*Transport, error) {
 	entry, err := c.dc.Entry(ctx, remote)
 	if err != nil {
@@ -263,13 +478,23 @@ func (c *Client) Dial(ctx context.Context, remote cipher.PubKey, port uint16) (*
 	if len(entry.Client.DelegatedServers) == 0 {
 		return nil, ErrNoSrv
 	}
+	var dialErr error // error of the last temporary dial failure
 	for _, srvPK := range entry.Client.DelegatedServers {
 		conn, err := c.findOrConnectToServer(ctx, srvPK)
 		if err != nil {
 			c.log.WithError(err).Warn("failed to connect to server")
 			continue
 		}
-		return conn.DialTransport(ctx, remote, port)
+		tp, err := conn.DialTransport(ctx, remote, port)
+		if err != nil && IsTemporary(err) && ctx.Err() == nil {
+			c.log.WithError(err).WithField("remoteServer", srvPK).Warn("failed to dial transport: trying next server")
+			dialErr = err
+			continue
+		}
+		return tp, err
+	}
+	if dialErr != nil {
+		return nil, dialErr
 	}
 	return nil, errors.New("failed to find dms_servers for given client pk")
 }
@@ -286,6 +511,11 @@ func (c *Client) Type() string {
 	return Type
 }
 
+// CapturedFramesDropped returns the number of captured frames which were dropped (see SetFrameCapture).
+func (c *Client) CapturedFramesDropped() uint64 {
+	return c.capture.Dropped()
+}
+
 // Close closes the dms_client and associated connections.
 // TODO(evaninjin): proper error handling.
 func (c *Client) Close() error {
@@ -311,6 +541,8 @@ func (c *Client) Close() error {
 		for _, lis := range c.pm.listeners {
 			lis.close()
 		}
+
+		c.capture.close()
 	})
 
 	return nil
@@ -1,12 +1,16 @@
 package dmsg
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/SkycoinProject/skycoin/src/util/logging"
@@ -16,9 +20,12 @@ import (
 
 // ClientConn represents a connection between a dmsg.Client and dmsg.Server from a client's perspective.
 type ClientConn struct {
+	bufSize int64 // total size of data buffered within transports (first field, for 64-bit aligned atomic access)
+
 	log *logging.Logger
 
 	net.Conn                // conn to dmsg server
+	r         io.Reader     // reader of frames from 'Conn' (may be buffered)
 	local     cipher.PubKey // local client's pk
 	remoteSrv cipher.PubKey // dmsg server's public key
 
@@ -32,6 +39,18 @@ type ClientConn struct {
 
 	pm *PortManager
 
+	connectedAt time.Time // time at which the ClientConn was created
+
+	bufMax int64 // limit of 'bufSize' at which ACK frames of received FWD frames are held back (0 means no limit)
+
+	unknownFrame UnknownFrameHandler // handles frames of unknown types received for transports
+	acceptLim    *acceptLimiter      // limits the rate of accepted transports (nil if unlimited)
+	maxRemoteTps int                 // maximum number of accepted transports per remote client (0 means no limit)
+
+	readCount  *frameCounter // counts of read frames
+	writeCount *frameCounter // counts of written frames
+	capture    *frameCapture // captures read/written frames (if set)
+
 	done chan struct{}
 	once sync.Once
 	wg   sync.WaitGroup
@@ -40,15 +59,19 @@ type ClientConn struct {
 // NewClientConn creates a new ClientConn.
 func NewClientConn(log *logging.Logger, conn net.Conn, local, remote cipher.PubKey, pm *PortManager) *ClientConn {
 	cc := &ClientConn{
-		log:        log,
-		Conn:       conn,
-		local:      local,
-		remoteSrv:  remote,
-		nextInitID: randID(true),
-		tps:        make(map[uint16]*Transport),
-		pm:         pm,
-		done:       make(chan struct{}),
+		log:         log,
+		local:       local,
+		remoteSrv:   remote,
+		nextInitID:  randID(true),
+		tps:         make(map[uint16]*Transport),
+		pm:          pm,
+		connectedAt: time.Now(),
+		readCount:   new(frameCounter),
+		writeCount:  new(frameCounter),
+		done:        make(chan struct{}),
 	}
+	cc.Conn = &observedConn{Conn: conn, observe: func(f Frame) { cc.observeFrame(CaptureOut, f) }}
+	cc.r = cc.Conn
 	cc.wg.Add(1)
 	return cc
 }
@@ -76,7 +99,8 @@ func (c *ClientConn) getNextInitID(ctx context.Context) (uint16, error) {
 	}
 }
 
-func (c *ClientConn) addTp(ctx context.Context, rPK cipher.PubKey, lPort, rPort uint16) (*Transport, error) {
+// addTp adds a locally-initiated transport. 'freePort' is called once the transport is closed.
+func (c *ClientConn) addTp(ctx context.Context, rPK cipher.PubKey, lPort, rPort uint16, freePort func()) (*Transport, error) {
 	c.mx.Lock()
 	defer c.mx.Unlock()
 
@@ -84,11 +108,22 @@ func (c *ClientConn) addTp(ctx context.Context, rPK cipher.PubKey, lPort, rPort
 	if err != nil {
 		return nil, err
 	}
-	tp := NewTransport(c.Conn, c.log, Addr{c.local, lPort}, Addr{rPK, rPort}, id, c.delTp)
+	doneFunc := func(id uint16) {
+		c.delTp(id)
+		freePort()
+	}
+	tp := NewTransport(c.Conn, c.log, Addr{c.local, lPort}, Addr{rPK, rPort}, id, doneFunc)
+	c.initTp(tp)
 	c.tps[id] = tp
 	return tp, nil
 }
 
+// initTp applies the ClientConn's settings to a newly created transport.
+func (c *ClientConn) initTp(tp *Transport) {
+	tp.bufNotify = c.addBufSize
+	tp.unknownFrame = c.unknownFrame
+}
+
 func (c *ClientConn) setTp(tp *Transport) {
 	c.mx.Lock()
 	c.tps[tp.id] = tp
@@ -109,19 +144,159 @@ func (c *ClientConn) getTp(id uint16) (*Transport, bool) {
 	return tp, ok
 }
 
+// CloseTransport closes the open transport that has the given remote address.
+// ErrTransportNotFound is returned if no such transport exists.
+func (c *ClientConn) CloseTransport(remote Addr) error {
+	c.mx.RLock()
+	var tp *Transport
+	for _, t := range c.tps {
+		if t != nil && !t.IsClosed() && t.remote == remote {
+			tp = t
+			break
+		}
+	}
+	c.mx.RUnlock()
+
+	if tp == nil {
+		return ErrTransportNotFound
+	}
+	return tp.Close()
+}
+
+// ClientConnInfo is a snapshot of the state of a ClientConn.
+type ClientConnInfo struct {
+	RemoteSrv     cipher.PubKey `json:"remote_server"`
+	Transports    int           `json:"transports"`     // number of open transports
+	ConnectedAt   time.Time     `json:"connected_at"`   // time at which the connection was established
+	BufferedBytes int           `json:"buffered_bytes"` // total size of data buffered within transports
+	BufferLimit   int           `json:"buffer_limit"`   // limit of BufferedBytes (0 means no limit)
+}
+
+// Info returns a snapshot of the state of the ClientConn.
+func (c *ClientConn) Info() ClientConnInfo {
+	c.mx.RLock()
+	n := 0
+	for _, tp := range c.tps {
+		if tp != nil && !tp.IsClosed() {
+			n++
+		}
+	}
+	c.mx.RUnlock()
+
+	return ClientConnInfo{
+		RemoteSrv:     c.remoteSrv,
+		Transports:    n,
+		ConnectedAt:   c.connectedAt,
+		BufferedBytes: int(atomic.LoadInt64(&c.bufSize)),
+		BufferLimit:   int(c.bufMax),
+	}
+}
+
+// setBufferLimit limits the total size of data buffered within transports. Once the limit is reached, transports
+// hold back the ACK frames of received FWD frames until buffered data is read, which pauses the remote writers.
+// Frames are still read from the connection, so local writes (which await ACK frames) are not blocked.
+// It should be called before the connection is served.
+func (c *ClientConn) setBufferLimit(n int) {
+	c.bufMax = int64(n)
+}
+
+// setReadBufferSize buffers reads from the connection with a buffer of size n (n <= 0 means unbuffered).
+// It should be called before the first frame is read.
+func (c *ClientConn) setReadBufferSize(n int) {
+	if n > 0 {
+		c.r = bufio.NewReaderSize(c.Conn, n)
+	}
+}
+
+// setAcceptLimiter limits the rate at which remotely-initiated transports are accepted (nil means unlimited).
+// It should be called before the connection is served.
+func (c *ClientConn) setAcceptLimiter(l *acceptLimiter) {
+	c.acceptLim = l
+}
+
+// setMaxRemoteTps limits the number of open remotely-initiated transports which each remote client can have.
+// It should be called before the connection is served.
+func (c *ClientConn) setMaxRemoteTps(n int) {
+	c.maxRemoteTps = n
+}
+
+// addRemoteTp adds a remotely-initiated transport to 'tps', unless its remote client has reached 'maxRemoteTps'.
+// Counting and adding happen under the same lock, so that concurrent REQUEST frames can not exceed the limit.
+func (c *ClientConn) addRemoteTp(tp *Transport) bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.maxRemoteTps > 0 {
+		n := 0
+		for id, t := range c.tps {
+			if t != nil && !isInitiatorID(id) && t.remote.PK == tp.remote.PK && !t.IsClosed() {
+				n++
+			}
+		}
+		if n >= c.maxRemoteTps {
+			return false
+		}
+	}
+	c.tps[tp.id] = tp
+	return true
+}
+
+// setUnknownFrameHandler sets the handler of frames of unknown types received for transports.
+// It should be called before the connection is served.
+func (c *ClientConn) setUnknownFrameHandler(h UnknownFrameHandler) {
+	c.unknownFrame = h
+}
+
+// addBufSize adds 'delta' to the size of buffered data, and returns whether the buffer limit is reached.
+func (c *ClientConn) addBufSize(delta int) bool {
+	n := atomic.AddInt64(&c.bufSize, int64(delta))
+	return c.bufMax > 0 && n >= c.bufMax
+}
+
 func (c *ClientConn) setNextInitID(nextInitID uint16) {
 	c.mx.Lock()
 	c.nextInitID = nextInitID
 	c.mx.Unlock()
 }
 
+// FrameCounts returns the number of frames of each frame type that are read from and written to the connection.
+func (c *ClientConn) FrameCounts() (read, written map[FrameType]uint64) {
+	return c.readCount.counts(), c.writeCount.counts()
+}
+
+// setCapture enables capturing of all frames read from and written to the connection.
+// It should be called before the connection is used.
+func (c *ClientConn) setCapture(fc *frameCapture) {
+	c.capture = fc
+}
+
+func (c *ClientConn) observeFrame(dir CaptureDirection, f Frame) {
+	if dir == CaptureIn {
+		c.readCount.add(f.Type())
+	} else {
+		c.writeCount.add(f.Type())
+	}
+	c.capture.capture(dir, f)
+}
+
+func (c *ClientConn) readFrame() (Frame, error) {
+	f, err := readFrame(c.r)
+	if err == nil {
+		c.observeFrame(CaptureIn, f)
+	}
+	return f, err
+}
+
 func (c *ClientConn) readOK() error {
-	fr, err := readFrame(c.Conn)
+	fr, err := c.readFrame()
 	if err != nil {
 		return errors.New("failed to get OK from server")
 	}
 
-	ft, _, _ := fr.Disassemble()
+	ft, _, p := fr.Disassemble()
+	if ft == CloseType && len(p) > 0 {
+		return ErrorFromCode(p[0]) // connection refused by server
+	}
 	if ft != OkType {
 		return fmt.Errorf("wrong frame from server: %v", ft)
 	}
@@ -136,16 +311,14 @@ func (c *ClientConn) handleRequestFrame(id uint16, p []byte) (cipher.PubKey, err
 	// - use an odd tp_id with the intermediary dmsg_server.
 	payload, err := unmarshalHandshakePayload(p)
 	if err != nil {
-		// TODO(nkryuchkov): When implementing reasons, send that payload format is incorrect.
-		if err := writeCloseFrame(c.Conn, id, PlaceholderReason); err != nil {
+		if err := writeCloseFrame(c.Conn, id, RequestCheckFailedReason); err != nil {
 			return cipher.PubKey{}, err
 		}
 		return cipher.PubKey{}, ErrRequestCheckFailed
 	}
 
 	if payload.RespPK != c.local || isInitiatorID(id) {
-		// TODO(nkryuchkov): When implementing reasons, send that payload is malformed.
-		if err := writeCloseFrame(c.Conn, id, PlaceholderReason); err != nil {
+		if err := writeCloseFrame(c.Conn, id, RequestCheckFailedReason); err != nil {
 			return payload.InitPK, err
 		}
 		return payload.InitPK, ErrRequestCheckFailed
@@ -153,26 +326,48 @@ func (c *ClientConn) handleRequestFrame(id uint16, p []byte) (cipher.PubKey, err
 
 	lis, ok := c.pm.Listener(payload.Port)
 	if !ok {
-		// TODO(nkryuchkov): When implementing reasons, send that port is not listening
-		if err := writeCloseFrame(c.Conn, id, PlaceholderReason); err != nil {
+		if err := writeCloseFrame(c.Conn, id, PortNotListeningReason); err != nil {
 			return payload.InitPK, err
 		}
 		return payload.InitPK, ErrPortNotListening
 	}
 
-	tp := NewTransport(c.Conn, c.log, Addr{c.local, payload.Port}, Addr{payload.InitPK, 0}, id, c.delTp) // TODO: Have proper remote port.
+	if lis.isAcceptMaxed() {
+		if err := writeCloseFrame(c.Conn, id, ClientAcceptMaxedReason); err != nil {
+			return payload.InitPK, err
+		}
+		return payload.InitPK, ErrClientAcceptMaxed
+	}
+
+	tp := NewTransport(c.Conn, c.log, Addr{c.local, payload.Port}, Addr{payload.InitPK, payload.InitPort}, id, c.delTp)
+	c.initTp(tp)
+
+	// The transport takes its slot of 'maxRemoteTps' now, and gives it back if it is not accepted.
+	if !c.addRemoteTp(tp) {
+		if err := writeCloseFrame(c.Conn, id, RemoteTpsMaxedReason); err != nil {
+			return payload.InitPK, err
+		}
+		return payload.InitPK, ErrRemoteTpsMaxed
+	}
+
+	// The rate limit is checked last, so that REQUEST frames refused by the checks above do not use up its tokens.
+	if !c.acceptLim.Allow() {
+		c.delTp(id)
+		if err := writeCloseFrame(c.Conn, id, ClientAcceptMaxedReason); err != nil {
+			return payload.InitPK, err
+		}
+		return payload.InitPK, ErrClientAcceptMaxed
+	}
 
 	select {
 	case <-c.done:
-		if err := tp.Close(); err != nil {
-			log.WithError(err).Warn("Failed to close transport")
-		}
+		tp.closeWithReason(ClientClosedReason)
 		return payload.InitPK, ErrClientClosed
 
 	default:
 		err := lis.IntroduceTransport(tp)
-		if err == nil || err == ErrClientAcceptMaxed {
-			c.setTp(tp)
+		if err != nil {
+			c.delTp(id)
 		}
 		return payload.InitPK, err
 	}
@@ -190,7 +385,7 @@ func (c *ClientConn) Serve(ctx context.Context) (err error) {
 	}()
 
 	for {
-		f, err := readFrame(c.Conn)
+		f, err := c.readFrame()
 		if err != nil {
 			return fmt.Errorf("read failed: %s", err)
 		}
@@ -242,12 +437,18 @@ func (c *ClientConn) Serve(ctx context.Context) (err error) {
 }
 
 // DialTransport dials a transport to remote dms_client.
+// The local port of the transport is a reserved ephemeral port.
 func (c *ClientConn) DialTransport(ctx context.Context, clientPK cipher.PubKey, port uint16) (*Transport, error) {
-	tp, err := c.addTp(ctx, clientPK, 0, port) // TODO: Have proper local port.
+	lPort, freePort, err := c.pm.ReserveEphemeralPort()
 	if err != nil {
 		return nil, err
 	}
-	if err := tp.WriteRequest(port); err != nil {
+	tp, err := c.addTp(ctx, clientPK, lPort, port, freePort)
+	if err != nil {
+		freePort()
+		return nil, err
+	}
+	if err := tp.WriteRequest(); err != nil {
 		return nil, err
 	}
 	if err := tp.ReadAccept(ctx); err != nil {
@@ -290,6 +491,26 @@ func (c *ClientConn) Close() error {
 	return nil
 }
 
+// observedConn calls 'observe' for each frame written to the underlying connection.
+type observedConn struct {
+	net.Conn
+	observe func(f Frame)
+}
+
+// Write expects 'b' to contain whole frames.
+func (c *observedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	for rem := b[:n]; len(rem) > 0; {
+		adv, f, splitErr := FrameSplit(rem, true)
+		if splitErr != nil || f == nil {
+			break
+		}
+		c.observe(f)
+		rem = rem[adv:]
+	}
+	return n, err
+}
+
 func marshalHandshakePayload(p HandshakePayload) ([]byte, error) {
 	return json.Marshal(p)
 }
@@ -1,7 +1,9 @@
 package dmsg
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"math"
 	"math/rand"
 	"net"
@@ -13,6 +15,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
 )
 
 type transportWithError struct {
@@ -130,6 +133,332 @@ func BenchmarkClientConn_setTp(b *testing.B) {
 	}
 }
 
+func TestClientConn_CloseTransport(t *testing.T) {
+	log := logging.MustGetLogger("dmsg_test")
+
+	p1, p2 := net.Pipe()
+	pk1, _ := cipher.GenerateKeyPair()
+	pk2, _ := cipher.GenerateKeyPair()
+	pk3, _ := cipher.GenerateKeyPair()
+
+	cc := NewClientConn(log, p1, pk1, pk2, newPortManager())
+	remote := Addr{PK: pk3, Port: port}
+	tp := NewTransport(cc.Conn, log, Addr{PK: pk1, Port: port}, remote, 2, cc.delTp)
+	cc.setTp(tp)
+
+	assert.Equal(t, ErrTransportNotFound, cc.CloseTransport(Addr{PK: pk3, Port: port + 1}))
+	assert.False(t, tp.IsClosed())
+
+	frames := make(chan Frame, 1)
+	go func() {
+		f, err := readFrame(p2)
+		if err == nil {
+			frames <- f
+		}
+		close(frames)
+	}()
+
+	require.NoError(t, cc.CloseTransport(remote))
+	assert.True(t, tp.IsClosed())
+	assert.Equal(t, MakeFrame(CloseType, 2, []byte{PlaceholderReason}), <-frames)
+
+	assert.Equal(t, ErrTransportNotFound, cc.CloseTransport(remote))
+
+	require.NoError(t, p1.Close())
+	require.NoError(t, p2.Close())
+}
+
+// TestClientConn_setBufferLimit ensures that ACK frames are held back while the size of data buffered within
+// transports is at the limit, and that frames are still read from the connection meanwhile (so that a goroutine
+// which reads from and then writes to a transport does not deadlock).
+func TestClientConn_setBufferLimit(t *testing.T) {
+	log := logging.MustGetLogger("dmsg_test")
+
+	p1, p2 := net.Pipe()
+	pk1, _ := cipher.GenerateKeyPair()
+	pk2, _ := cipher.GenerateKeyPair()
+
+	cc := NewClientConn(log, p1, pk1, pk2, newPortManager())
+	cc.setBufferLimit(4)
+	tp := NewTransport(cc.Conn, log, Addr{}, Addr{}, 1, cc.delTp)
+	cc.initTp(tp)
+	cc.setTp(tp)
+	go tp.Serve()
+
+	// The remote acknowledges FWD frames, and reports received ACK frames.
+	acks := make(chan Frame, 1)
+	go func() {
+		for f := range readFrames(p2) {
+			switch ft, id, p := f.Disassemble(); ft {
+			case FwdType:
+				_ = writeFrame(p2, MakeFrame(AckType, id, p[:2])) // nolint:errcheck
+			case AckType:
+				acks <- f
+			}
+		}
+	}()
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- cc.Serve(context.TODO())
+		close(serveErrCh)
+	}()
+
+	require.NoError(t, writeFrame(p2, MakeFrame(FwdType, 1, []byte{0, 0, 1, 2, 3, 4, 5, 6})))
+
+	errCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 2)
+		if _, err := tp.Read(buf); err != nil {
+			errCh <- err
+			return
+		}
+		_, err := tp.Write([]byte{7}) // awaits an ACK frame while 4 bytes are still buffered
+		errCh <- err
+	}()
+	require.NoError(t, errWithTimeout(errCh))
+	assert.Equal(t, 4, cc.Info().BufferedBytes)
+
+	select {
+	case <-acks:
+		t.Fatal("ACK frame is sent while buffer limit is reached")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	buf := make([]byte, 4)
+	n, err := tp.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{3, 4, 5, 6}, buf[:n])
+	select {
+	case f := <-acks:
+		assert.Equal(t, MakeFrame(AckType, 1, []byte{0, 0}), f)
+	case <-time.After(time.Second):
+		t.Fatal("held back ACK frame is not sent once buffered data is read")
+	}
+
+	require.NoError(t, cc.Close())
+	require.NoError(t, p2.Close())
+	assert.Error(t, errWithTimeout(serveErrCh))
+}
+
+// readCountConn is a net.Conn which reads from 'r' and counts the reads performed.
+type readCountConn struct {
+	net.Conn
+	r     io.Reader
+	reads int
+}
+
+func (c *readCountConn) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func TestClientConn_setReadBufferSize(t *testing.T) {
+	log := logging.MustGetLogger("dmsg_test")
+	pk1, _ := cipher.GenerateKeyPair()
+	pk2, _ := cipher.GenerateKeyPair()
+
+	const frames = 10
+	var b bytes.Buffer
+	for i := 0; i < frames; i++ {
+		b.Write(MakeFrame(FwdType, 1, []byte{0, byte(i), 1}))
+	}
+
+	cases := []struct {
+		size     int
+		maxReads int
+	}{
+		{0, frames * 2},
+		{4096, 1},
+	}
+	for _, tc := range cases {
+		p1, _ := net.Pipe()
+		conn := &readCountConn{Conn: p1, r: bytes.NewReader(b.Bytes())}
+		cc := NewClientConn(log, conn, pk1, pk2, newPortManager())
+		cc.setReadBufferSize(tc.size)
+
+		for i := 0; i < frames; i++ {
+			f, err := cc.readFrame()
+			require.NoError(t, err)
+			assert.Equal(t, []byte{0, byte(i), 1}, f.Pay())
+		}
+		assert.True(t, conn.reads <= tc.maxReads, "size=%d reads=%d", tc.size, conn.reads)
+		require.NoError(t, p1.Close())
+	}
+}
+
+func BenchmarkClientConn_readFrame_unbuffered(b *testing.B) {
+	benchmarkClientConnReadFrame(b, 0)
+}
+
+func BenchmarkClientConn_readFrame_buffered(b *testing.B) {
+	benchmarkClientConnReadFrame(b, 4096)
+}
+
+func benchmarkClientConnReadFrame(b *testing.B, bufSize int) {
+	log := logging.MustGetLogger("dmsg_test")
+	pk1, _ := cipher.GenerateKeyPair()
+	pk2, _ := cipher.GenerateKeyPair()
+
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Write(MakeFrame(FwdType, 1, []byte{0, 0, 1, 2, 3, 4}))
+	}
+	p1, _ := net.Pipe()
+	conn := &readCountConn{Conn: p1, r: &buf}
+	cc := NewClientConn(log, conn, pk1, pk2, newPortManager())
+	cc.setReadBufferSize(bufSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cc.readFrame(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestClientConn_handleRequestFrame ensures that REQUEST frames exceeding the accept limits are refused.
+func TestClientConn_handleRequestFrame(t *testing.T) {
+	log := logging.MustGetLogger("dmsg_test")
+
+	lPK, _ := cipher.GenerateKeyPair()
+	srvPK, _ := cipher.GenerateKeyPair()
+	rPK1, _ := cipher.GenerateKeyPair()
+	rPK2, _ := cipher.GenerateKeyPair()
+	rPK3, _ := cipher.GenerateKeyPair()
+
+	type request struct {
+		id        uint16
+		remote    cipher.PubKey
+		wantErr   error
+		wantFrame Frame
+	}
+	accept := func(id uint16, remote cipher.PubKey) request {
+		return request{id: id, remote: remote, wantFrame: MakeFrame(AcceptType, id, combinePKs(remote, lPK))}
+	}
+	refuse := func(id uint16, remote cipher.PubKey, err error) request {
+		return request{id: id, remote: remote, wantErr: err, wantFrame: MakeFrame(CloseType, id, []byte{CodeForError(err)})}
+	}
+
+	cases := []struct {
+		name     string
+		setup    func(cc *ClientConn)
+		requests []request
+	}{
+		{
+			name:     "Accept rate limit",
+			setup:    func(cc *ClientConn) { cc.setAcceptLimiter(newAcceptLimiter(0.001, 1)) },
+			requests: []request{accept(1, rPK1), refuse(3, rPK1, ErrClientAcceptMaxed)},
+		},
+		{
+			name:     "Max transports per remote",
+			setup:    func(cc *ClientConn) { cc.setMaxRemoteTps(1) },
+			requests: []request{accept(1, rPK1), refuse(3, rPK1, ErrRemoteTpsMaxed), accept(5, rPK2)},
+		},
+		{
+			name: "Refused requests do not use up accept rate limit",
+			setup: func(cc *ClientConn) {
+				cc.setAcceptLimiter(newAcceptLimiter(0.001, 2))
+				cc.setMaxRemoteTps(1)
+			},
+			requests: []request{
+				accept(1, rPK1),
+				refuse(3, rPK1, ErrRemoteTpsMaxed),
+				refuse(5, rPK1, ErrRemoteTpsMaxed),
+				accept(7, rPK2),
+				refuse(9, rPK3, ErrClientAcceptMaxed),
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p1, p2 := net.Pipe()
+			defer func() {
+				require.NoError(t, p1.Close())
+				require.NoError(t, p2.Close())
+			}()
+
+			pm := newPortManager()
+			_, ok := pm.NewListener(lPK, port)
+			require.True(t, ok)
+
+			cc := NewClientConn(log, p1, lPK, srvPK, pm)
+			tc.setup(cc)
+			frames := readFrames(p2)
+
+			for _, r := range tc.requests {
+				hs, err := marshalHandshakePayload(HandshakePayload{
+					Version:  HandshakePayloadVersion,
+					InitPK:   r.remote,
+					RespPK:   lPK,
+					Port:     port,
+					InitPort: 1,
+				})
+				require.NoError(t, err)
+
+				_, err = cc.handleRequestFrame(r.id, hs)
+				assert.Equal(t, r.wantErr, err)
+				assert.Equal(t, r.wantFrame, <-frames)
+			}
+		})
+	}
+}
+
+// TestClientConn_setMaxRemoteTps ensures that concurrent REQUEST frames of a remote client
+// can not exceed the maximum number of transports per remote client.
+func TestClientConn_setMaxRemoteTps(t *testing.T) {
+	const (
+		max      = 2
+		requests = 10
+	)
+	log := logging.MustGetLogger("dmsg_test")
+
+	lPK, _ := cipher.GenerateKeyPair()
+	srvPK, _ := cipher.GenerateKeyPair()
+	rPK, _ := cipher.GenerateKeyPair()
+
+	p1, p2 := net.Pipe()
+	pm := newPortManager()
+	_, ok := pm.NewListener(lPK, port)
+	require.True(t, ok)
+
+	cc := NewClientConn(log, p1, lPK, srvPK, pm)
+	cc.setMaxRemoteTps(max)
+	frames := readFrames(p2)
+
+	hs, err := marshalHandshakePayload(HandshakePayload{Version: HandshakePayloadVersion, InitPK: rPK, RespPK: lPK, Port: port})
+	require.NoError(t, err)
+
+	errCh := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func(id uint16) {
+			_, err := cc.handleRequestFrame(id, hs)
+			errCh <- err
+		}(uint16(2*i + 1))
+	}
+
+	accepted := 0
+	for i := 0; i < requests; i++ {
+		switch err := <-errCh; err {
+		case nil:
+			accepted++
+		default:
+			assert.Equal(t, ErrRemoteTpsMaxed, err)
+		}
+	}
+	assert.Equal(t, max, accepted)
+
+	counts := make(map[FrameType]int)
+	for i := 0; i < requests; i++ {
+		counts[(<-frames).Type()]++
+	}
+	assert.Equal(t, map[FrameType]int{AcceptType: max, CloseType: requests - max}, counts)
+
+	require.NoError(t, p1.Close())
+	require.NoError(t, p2.Close())
+}
+
 func TestClient(t *testing.T) {
 	logger := logging.MustGetLogger("dmsg_client")
 
@@ -180,6 +509,15 @@ func TestClient(t *testing.T) {
 		conn1.mx.RUnlock()
 		assert.Equal(t, initID+2, newInitID)
 
+		info := conn1.Info()
+		assert.Equal(t, pk2, info.RemoteSrv)
+		assert.Equal(t, 1, info.Transports)
+		assert.False(t, info.ConnectedAt.IsZero())
+
+		read, written := conn1.FrameCounts()
+		assert.Equal(t, map[FrameType]uint64{AcceptType: 1}, read)
+		assert.Equal(t, map[FrameType]uint64{RequestType: 1}, written)
+
 		assert.NoError(t, closeClosers(conn1, conn2))
 		checkClientConnsClosed(t, conn1, conn2)
 
@@ -379,3 +717,66 @@ func (c invertedIDConn) Write(b []byte) (n int, err error) {
 	newFrame := MakeFrame(frame.Type(), frame.TpID()^1, frame.Pay())
 	return c.Conn.Write(newFrame)
 }
+
+func TestClient_Conns(t *testing.T) {
+	dc := disc.NewMock()
+	srv, srvErrCh, err := createServer(dc)
+	require.NoError(t, err)
+
+	responder := createClient(t, dc, responderName)
+	initiator := createClient(t, dc, initiatorName)
+
+	infos := initiator.Conns()
+	require.Len(t, infos, 1)
+	assert.Equal(t, srv.pk, infos[0].RemoteSrv)
+	assert.Equal(t, 0, infos[0].Transports)
+
+	initTp, respTp := dial(t, initiator, responder, port, noDelay)
+
+	infos = initiator.Conns()
+	require.Len(t, infos, 1)
+	assert.Equal(t, 1, infos[0].Transports)
+
+	require.NoError(t, closeClosers(initTp, respTp, initiator, responder))
+	assert.Len(t, initiator.Conns(), 0)
+
+	require.NoError(t, srv.Close())
+	require.NoError(t, errWithTimeout(srvErrCh))
+}
+
+func Test_nextReconnectInterval(t *testing.T) {
+	interval := time.Second
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		interval = nextReconnectInterval(interval, 10*time.Second)
+		got = append(got, interval)
+	}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	assert.Equal(t, want, got)
+}
+
+func TestClient_reconnectLimit(t *testing.T) {
+	pk, sk := cipher.GenerateKeyPair()
+	c := NewClient(pk, sk, disc.NewMock(), SetMaxConcurrentReconnects(1))
+	ctx := context.TODO()
+
+	require.True(t, c.acquireReconnect(ctx))
+
+	acquired := make(chan bool, 1)
+	go func() { acquired <- c.acquireReconnect(ctx) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("reconnect limit exceeded")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.releaseReconnect()
+	assert.True(t, <-acquired)
+	c.releaseReconnect()
+
+	// Pending attempts are abandoned once the client is closed.
+	require.True(t, c.acquireReconnect(ctx))
+	require.NoError(t, c.Close())
+	assert.False(t, c.acquireReconnect(ctx))
+}
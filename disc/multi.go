@@ -0,0 +1,66 @@
+package disc
+
+import (
+	"context"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// multiClient is an APIClient which fails over between multiple APIClients.
+type multiClient struct {
+	clients []APIClient
+}
+
+// NewMulti creates an APIClient which fails over between the given APIClients.
+// Each call is attempted on 'c' and then on each of 'fallbacks' in order, until an attempt succeeds.
+// If all attempts fail, the error of the last attempt is returned.
+func NewMulti(c APIClient, fallbacks ...APIClient) APIClient {
+	return &multiClient{clients: append([]APIClient{c}, fallbacks...)}
+}
+
+// Entry retrieves an entry associated with the given public key from the first APIClient which succeeds.
+func (m *multiClient) Entry(ctx context.Context, pk cipher.PubKey) (entry *Entry, err error) {
+	err = m.do(ctx, func(c APIClient) (err error) {
+		entry, err = c.Entry(ctx, pk)
+		return err
+	})
+	return entry, err
+}
+
+// SetEntry writes a new entry to the first APIClient which succeeds.
+func (m *multiClient) SetEntry(ctx context.Context, e *Entry) error {
+	return m.do(ctx, func(c APIClient) error {
+		return c.SetEntry(ctx, e)
+	})
+}
+
+// UpdateEntry updates an entry via the first APIClient which succeeds.
+func (m *multiClient) UpdateEntry(ctx context.Context, sk cipher.SecKey, e *Entry) error {
+	return m.do(ctx, func(c APIClient) error {
+		return c.UpdateEntry(ctx, sk, e)
+	})
+}
+
+// AvailableServers returns list of available servers from the first APIClient which succeeds.
+func (m *multiClient) AvailableServers(ctx context.Context) (entries []*Entry, err error) {
+	err = m.do(ctx, func(c APIClient) (err error) {
+		entries, err = c.AvailableServers(ctx)
+		return err
+	})
+	return entries, err
+}
+
+func (m *multiClient) do(ctx context.Context, action func(c APIClient) error) (err error) {
+	for i, c := range m.clients {
+		if err = action(c); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if i < len(m.clients)-1 {
+			log.WithError(err).Warn("Discovery request failed: trying next client")
+		}
+	}
+	return err
+}
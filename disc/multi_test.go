@@ -0,0 +1,68 @@
+package disc_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+var errUnavailable = errors.New("discovery unavailable")
+
+// failingClient is an APIClient for which all calls fail.
+type failingClient struct{}
+
+func (failingClient) Entry(context.Context, cipher.PubKey) (*disc.Entry, error) {
+	return nil, errUnavailable
+}
+
+func (failingClient) SetEntry(context.Context, *disc.Entry) error {
+	return errUnavailable
+}
+
+func (failingClient) UpdateEntry(context.Context, cipher.SecKey, *disc.Entry) error {
+	return errUnavailable
+}
+
+func (failingClient) AvailableServers(context.Context) ([]*disc.Entry, error) {
+	return nil, errUnavailable
+}
+
+func TestNewMulti(t *testing.T) {
+	ctx := context.TODO()
+	pk, sk := cipher.GenerateKeyPair()
+
+	mock := disc.NewMock()
+	multi := disc.NewMulti(failingClient{}, mock)
+
+	entry := disc.NewServerEntry(pk, 0, "localhost:8080", 10)
+	require.NoError(t, entry.Sign(sk))
+	require.NoError(t, multi.SetEntry(ctx, entry))
+
+	got, err := multi.Entry(ctx, pk)
+	require.NoError(t, err)
+	assert.Equal(t, entry, got)
+
+	entry.Server.Address = "localhost:8081"
+	require.NoError(t, multi.UpdateEntry(ctx, sk, entry))
+
+	got, err = multi.Entry(ctx, pk)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:8081", got.Server.Address)
+
+	servers, err := multi.AvailableServers(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, servers)
+	for _, s := range servers {
+		assert.Equal(t, pk, s.Static)
+	}
+
+	// The error of the last attempt is returned if all attempts fail.
+	_, err = disc.NewMulti(mock, failingClient{}).Entry(ctx, cipher.PubKey{})
+	assert.Equal(t, errUnavailable, err)
+}
@@ -0,0 +1,32 @@
+package disc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+// ErrReadOnly occurs when a mutating method is called on a read-only APIClient.
+var ErrReadOnly = errors.New("discovery client is read-only")
+
+// readOnlyClient wraps an APIClient, only allowing read access.
+type readOnlyClient struct {
+	APIClient
+}
+
+// NewReadOnly wraps an APIClient so that it can only be used to query discovery.
+// The mutating methods (SetEntry and UpdateEntry) of the returned APIClient always fail with ErrReadOnly.
+func NewReadOnly(c APIClient) APIClient {
+	return &readOnlyClient{APIClient: c}
+}
+
+// SetEntry always returns ErrReadOnly.
+func (*readOnlyClient) SetEntry(context.Context, *Entry) error {
+	return ErrReadOnly
+}
+
+// UpdateEntry always returns ErrReadOnly.
+func (*readOnlyClient) UpdateEntry(context.Context, cipher.SecKey, *Entry) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,40 @@
+package disc_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+	"github.com/SkycoinProject/dmsg/disc"
+)
+
+func TestNewReadOnly(t *testing.T) {
+	ctx := context.TODO()
+	pk, sk := cipher.GenerateKeyPair()
+
+	mock := disc.NewMock()
+	entry := disc.NewServerEntry(pk, 0, "localhost:8080", 10)
+	require.NoError(t, entry.Sign(sk))
+	require.NoError(t, mock.SetEntry(ctx, entry))
+
+	ro := disc.NewReadOnly(mock)
+
+	got, err := ro.Entry(ctx, pk)
+	require.NoError(t, err)
+	assert.Equal(t, entry, got)
+
+	servers, err := ro.AvailableServers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, servers, 1)
+
+	assert.Equal(t, disc.ErrReadOnly, ro.SetEntry(ctx, entry))
+	assert.Equal(t, disc.ErrReadOnly, ro.UpdateEntry(ctx, sk, entry))
+
+	// entry within the wrapped client should be unchanged.
+	got, err = mock.Entry(ctx, pk)
+	require.NoError(t, err)
+	assert.Equal(t, entry, got)
+}
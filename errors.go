@@ -0,0 +1,74 @@
+package dmsg
+
+// Reasons for closing frames.
+// A reason is sent as the first byte of a CLOSE frame's payload and represents why the transport is closed.
+// These values are part of the wire protocol and must not change.
+const (
+	PlaceholderReason        = byte(0x0) // unspecified reason
+	RequestRejectedReason    = byte(0x1) // ErrRequestRejected
+	RequestCheckFailedReason = byte(0x2) // ErrRequestCheckFailed
+	AcceptCheckFailedReason  = byte(0x3) // ErrAcceptCheckFailed
+	PortNotListeningReason   = byte(0x4) // ErrPortNotListening
+	ClientAcceptMaxedReason  = byte(0x5) // ErrClientAcceptMaxed
+	ClientClosedReason       = byte(0x6) // ErrClientClosed
+	UnknownFrameTypeReason   = byte(0x7) // ErrUnknownFrameType
+	ServerConnsMaxedReason   = byte(0x8) // ErrServerConnsMaxed
+	RemoteTpsMaxedReason     = byte(0x9) // ErrRemoteTpsMaxed
+)
+
+var (
+	reasonErrors = map[byte]error{
+		RequestRejectedReason:    ErrRequestRejected,
+		RequestCheckFailedReason: ErrRequestCheckFailed,
+		AcceptCheckFailedReason:  ErrAcceptCheckFailed,
+		PortNotListeningReason:   ErrPortNotListening,
+		ClientAcceptMaxedReason:  ErrClientAcceptMaxed,
+		ClientClosedReason:       ErrClientClosed,
+		UnknownFrameTypeReason:   ErrUnknownFrameType,
+		ServerConnsMaxedReason:   ErrServerConnsMaxed,
+		RemoteTpsMaxedReason:     ErrRemoteTpsMaxed,
+	}
+	errorReasons = func() map[error]byte {
+		m := make(map[error]byte, len(reasonErrors))
+		for code, err := range reasonErrors {
+			m[err] = code
+		}
+		return m
+	}()
+)
+
+// CodeForError returns the CLOSE frame reason that represents the given error.
+// PlaceholderReason is returned for errors without an associated reason.
+func CodeForError(err error) byte {
+	if code, ok := errorReasons[err]; ok {
+		return code
+	}
+	return PlaceholderReason
+}
+
+// ErrorFromCode returns the error represented by the given CLOSE frame reason.
+// ErrRequestRejected is returned for unspecified or unknown reasons.
+func ErrorFromCode(code byte) error {
+	if err, ok := reasonErrors[code]; ok {
+		return err
+	}
+	return ErrRequestRejected
+}
+
+// IsTemporary returns whether the given error is transient, such that retrying the failed operation may succeed.
+// Errors which implement `Temporary() bool` (such as net.Error) are honoured. Errors represented by CLOSE frame
+// reasons are permanent (as the remote explicitly refused), with the exception of ErrClientAcceptMaxed,
+// ErrServerConnsMaxed and ErrRemoteTpsMaxed.
+// Other errors are assumed to be temporary.
+func IsTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := errorReasons[err]; ok {
+		return err == ErrClientAcceptMaxed || err == ErrServerConnsMaxed || err == ErrRemoteTpsMaxed
+	}
+	if t, ok := err.(interface{ Temporary() bool }); ok {
+		return t.Temporary()
+	}
+	return true
+}
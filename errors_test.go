@@ -0,0 +1,50 @@
+package dmsg
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeForError(t *testing.T) {
+	for code, err := range reasonErrors {
+		assert.Equal(t, code, CodeForError(err))
+		assert.Equal(t, err, ErrorFromCode(code))
+	}
+
+	t.Run("Unknown error", func(t *testing.T) {
+		assert.Equal(t, PlaceholderReason, CodeForError(errors.New("unknown")))
+	})
+
+	t.Run("Unknown code", func(t *testing.T) {
+		assert.Equal(t, ErrRequestRejected, ErrorFromCode(PlaceholderReason))
+		assert.Equal(t, ErrRequestRejected, ErrorFromCode(0xff))
+	})
+}
+
+type temporaryError bool
+
+func (e temporaryError) Error() string   { return "temporary error" }
+func (e temporaryError) Temporary() bool { return bool(e) }
+
+func TestIsTemporary(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: ErrRequestRejected, want: false},
+		{err: ErrPortNotListening, want: false},
+		{err: ErrClientClosed, want: false},
+		{err: ErrClientAcceptMaxed, want: true},
+		{err: ErrServerConnsMaxed, want: true},
+		{err: ErrRemoteTpsMaxed, want: true},
+		{err: temporaryError(true), want: true},
+		{err: temporaryError(false), want: false},
+		{err: errors.New("unknown"), want: true},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, IsTemporary(tc.err), tc.err)
+	}
+}
@@ -2,13 +2,17 @@ package dmsg
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/SkycoinProject/dmsg/ioutil"
+	"github.com/SkycoinProject/dmsg/noise"
 
 	"github.com/SkycoinProject/dmsg/cipher"
 )
@@ -23,24 +27,47 @@ const (
 	tpBufCap      = math.MaxUint16
 	tpBufFrameCap = math.MaxUint8
 	tpAckCap      = math.MaxUint8
-	headerLen     = 5 // fType(1 byte), chID(2 byte), payLen(2 byte)
+	headerLen     = 5             // fType(1 byte), chID(2 byte), payLen(2 byte)
+	maxCloseMsg   = math.MaxUint8 // CLOSE messages are prefixed with a uint8 length
 )
 
+// maxFwdPayLen is the maximum size of data within a FWD frame (excluding the uint16 sequence), such that the frame
+// fits within a single write to a noise-encrypted connection.
+const maxFwdPayLen = math.MaxUint16 - noise.Overhead - headerLen - 2
+
 var (
 	// TransportHandshakeTimeout defines the duration a transport handshake should take.
 	TransportHandshakeTimeout = time.Second * 10
 
+	// TransportAcceptTimeout defines the maximum duration that dialing a transport waits for the remote's
+	// ACCEPT (or CLOSE) frame after sending the REQUEST frame. It is applied to transports as they are created.
+	TransportAcceptTimeout = time.Second * 10
+
 	// AcceptBufferSize defines the size of the accepts buffer.
 	AcceptBufferSize = 20
+
+	// TransportCloseTimeout defines the maximum duration that closing a transport waits for the CLOSE frame
+	// to be written. Once exceeded, the transport is closed without the remote being notified.
+	// The write is not abandoned though: the tp_id (and port) of the transport are only released once the write
+	// completes or fails, so that a late CLOSE frame can not close a new transport which reuses the tp_id.
+	// It is applied to transports as they are created.
+	TransportCloseTimeout = time.Second * 5
+
+	// TransportCoalesceDelay defines the maximum duration that small writes are held back to be coalesced
+	// into a single FWD frame, for transports with coalescing enabled (see Transport.SetNoDelay).
+	TransportCoalesceDelay = time.Millisecond * 10
+
+	// TransportCoalesceSize defines the size at which coalesced writes are sent without further delay.
+	TransportCoalesceSize = 1024
 )
 
 // HandshakePayload represents format of payload sent with REQUEST frames.
-// TODO(evanlinjin): Use 'dmsg.Addr' for PK:Port pair.
 type HandshakePayload struct {
-	Version string        `json:"version"` // just in case the struct changes.
-	InitPK  cipher.PubKey `json:"init_pk"`
-	RespPK  cipher.PubKey `json:"resp_pk"`
-	Port    uint16        `json:"port"`
+	Version  string        `json:"version"` // just in case the struct changes.
+	InitPK   cipher.PubKey `json:"init_pk"`
+	RespPK   cipher.PubKey `json:"resp_pk"`
+	Port     uint16        `json:"port"`
+	InitPort uint16        `json:"init_port,omitempty"` // not set by older clients
 }
 
 func isInitiatorID(tpID uint16) bool { return tpID%2 == 0 }
@@ -72,13 +99,43 @@ func (ft FrameType) String() string {
 		AckType:     "ACK",
 		OkType:      "OK",
 	}
-	if int(ft) >= len(names) {
+	if !ft.IsKnown() {
 		return fmt.Sprintf("UNKNOWN:%d", ft)
 	}
 	return names[ft]
 }
 
+// IsKnown returns whether the frame type is one of the defined frame types.
+func (ft FrameType) IsKnown() bool {
+	switch ft {
+	case OkType, RequestType, AcceptType, CloseType, FwdType, AckType:
+		return true
+	default:
+		return false
+	}
+}
+
+// frameCounter counts frames of each frame type.
+type frameCounter [math.MaxUint8 + 1]uint64
+
+func (fc *frameCounter) add(ft FrameType) {
+	atomic.AddUint64(&fc[ft], 1)
+}
+
+// counts returns the counts of the frame types which were counted at least once.
+func (fc *frameCounter) counts() map[FrameType]uint64 {
+	m := make(map[FrameType]uint64)
+	for ft := range fc {
+		if n := atomic.LoadUint64(&fc[ft]); n > 0 {
+			m[FrameType(ft)] = n
+		}
+	}
+	return m
+}
+
 // Frame types.
+// OkType frames are not part of a transport's lifecycle: a dmsg.Server sends a single OK frame (with tp_id 0 and
+// an empty payload) once the connection with a dmsg.Client is established, and the client waits for it before use.
 const (
 	OkType      = FrameType(0x0)
 	RequestType = FrameType(0x1)
@@ -88,24 +145,52 @@ const (
 	AckType     = FrameType(0xb)
 )
 
-// Reasons for closing frames
-const (
-	PlaceholderReason = iota
-)
-
 // Frame is the dmsg data unit.
 type Frame []byte
 
 // MakeFrame creates a new Frame.
 func MakeFrame(ft FrameType, chID uint16, pay []byte) Frame {
 	f := make(Frame, headerLen+len(pay))
+	setFrameHeader(f, ft, chID)
+	copy(f[5:], pay)
+	return f
+}
+
+// setFrameHeader fills the header of 'f'. The payload size is derived from the length of 'f'.
+func setFrameHeader(f Frame, ft FrameType, chID uint16) {
 	f[0] = byte(ft)
 	binary.BigEndian.PutUint16(f[1:3], chID)
-	binary.BigEndian.PutUint16(f[3:5], uint16(len(pay)))
-	copy(f[5:], pay)
+	binary.BigEndian.PutUint16(f[3:5], uint16(len(f)-headerLen))
+}
+
+// framePool holds frame buffers for the write paths, to reduce allocations.
+//
+// Ownership contract: a Frame obtained via getFrame belongs to the caller until it is handed back via putFrame.
+// After putFrame, neither the Frame nor any slice of it may be referenced.
+// As io.Writer implementations must not retain the slice passed to Write,
+// a frame can be returned to the pool as soon as writeFrame returns.
+var framePool = sync.Pool{
+	New: func() interface{} { return new(Frame) },
+}
+
+// getFrame obtains a Frame of the given size (header included) from the pool.
+// The contents of the returned Frame are undefined.
+// The pointer is handed back via putFrame, so that putting does not allocate.
+func getFrame(size int) *Frame {
+	f := framePool.Get().(*Frame)
+	if cap(*f) < size {
+		*f = make(Frame, size)
+	} else {
+		*f = (*f)[:size]
+	}
 	return f
 }
 
+// putFrame returns a Frame obtained via getFrame to the pool.
+func putFrame(f *Frame) {
+	framePool.Put(f)
+}
+
 // Type returns the frame's type.
 func (f Frame) Type() FrameType { return FrameType(f[0]) }
 
@@ -133,14 +218,135 @@ func (f Frame) String() string {
 	return fmt.Sprintf("<type:%s><id:%d><size:%d>%s", f.Type(), f.TpID(), f.PayLen(), p)
 }
 
+// Errors related to parsing frames.
+var (
+	ErrFrameHeaderTooShort = errors.New("frame header is too short")
+	ErrFramePayloadShort   = errors.New("frame payload is shorter than specified by header")
+	ErrFrameTrailingBytes  = errors.New("frame has trailing bytes after payload")
+	ErrInvalidFramePayload = errors.New("frame payload is invalid for frame type")
+)
+
+// ParseFrame validates that 'b' contains exactly one complete frame and returns it.
+// It is intended for packet-oriented connections which deliver whole frames at once.
+// The returned Frame references 'b' (no copy is made).
+func ParseFrame(b []byte) (Frame, error) {
+	if len(b) < headerLen {
+		return nil, ErrFrameHeaderTooShort
+	}
+	f := Frame(b)
+	switch payLen := len(b) - headerLen; {
+	case payLen < f.PayLen():
+		return nil, ErrFramePayloadShort
+	case payLen > f.PayLen():
+		return nil, ErrFrameTrailingBytes
+	}
+	return f, nil
+}
+
+// DisassembledFrame contains the validated contents of a frame.
+// Only the fields which are relevant to the frame's type are set.
+type DisassembledFrame struct {
+	Type      FrameType
+	TpID      uint16
+	Seq       ioutil.Uint16Seq // FWD and ACK frames
+	Data      []byte           // FWD frames (references the parsed bytes)
+	Reason    byte             // CLOSE frames
+	Message   string           // CLOSE frames (optional, see writeCloseFrameWithMessage)
+	Handshake HandshakePayload // REQUEST frames
+	InitPK    cipher.PubKey    // ACCEPT frames
+	RespPK    cipher.PubKey    // ACCEPT frames
+}
+
+// ParseAndValidateFrame parses 'b' as exactly one frame (see ParseFrame) and validates the frame's payload
+// against the frame's type. ErrUnknownFrameType is returned for frames of unknown types.
+// It is a pure function of 'b', and is intended to be safe to call with arbitrary (untrusted) input.
+func ParseAndValidateFrame(b []byte) (DisassembledFrame, error) {
+	f, err := ParseFrame(b)
+	if err != nil {
+		return DisassembledFrame{}, err
+	}
+	ft, id, p := f.Disassemble()
+	df := DisassembledFrame{Type: ft, TpID: id}
+
+	switch ft {
+	case OkType:
+		if len(p) != 0 {
+			return DisassembledFrame{}, ErrInvalidFramePayload
+		}
+	case RequestType:
+		if df.Handshake, err = unmarshalHandshakePayload(p); err != nil {
+			return DisassembledFrame{}, ErrInvalidFramePayload
+		}
+	case AcceptType:
+		var ok bool
+		if df.InitPK, df.RespPK, ok = splitPKs(p); !ok {
+			return DisassembledFrame{}, ErrInvalidFramePayload
+		}
+	case CloseType:
+		var ok bool
+		if df.Message, ok = closeMessage(p); !ok {
+			return DisassembledFrame{}, ErrInvalidFramePayload
+		}
+		df.Reason = p[0]
+	case FwdType:
+		if len(p) < 2 {
+			return DisassembledFrame{}, ErrInvalidFramePayload
+		}
+		df.Seq, df.Data = ioutil.DecodeUint16Seq(p), p[2:]
+	case AckType:
+		if len(p) != 2 {
+			return DisassembledFrame{}, ErrInvalidFramePayload
+		}
+		df.Seq = ioutil.DecodeUint16Seq(p)
+	default:
+		return DisassembledFrame{}, ErrUnknownFrameType
+	}
+	return df, nil
+}
+
+// FrameSplit is a bufio.SplitFunc which splits a byte stream into frames.
+// Each token (obtained via bufio.Scanner.Bytes) is a complete Frame, header included.
+// Note that a frame can be larger than bufio.MaxScanTokenSize, so the scanner's buffer should be
+// set (via bufio.Scanner.Buffer) to allow tokens of at least 5+math.MaxUint16 bytes.
+func FrameSplit(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) < headerLen {
+		if atEOF && len(data) > 0 {
+			return 0, nil, ErrFrameHeaderTooShort
+		}
+		return 0, nil, nil
+	}
+	n := headerLen + Frame(data).PayLen()
+	if len(data) < n {
+		if atEOF {
+			return 0, nil, ErrFramePayloadShort
+		}
+		return 0, nil, nil
+	}
+	return n, data[:n], nil
+}
+
+// ShortFrameError occurs when a frame's header is read, but the reader ends before the payload is fully read.
+type ShortFrameError struct {
+	Type   FrameType // type of the frame
+	PayLen int       // payload length, as specified by the frame's header
+	Read   int       // number of payload bytes actually read
+	Err    error     // underlying read error
+}
+
+func (e *ShortFrameError) Error() string {
+	return fmt.Sprintf("short frame: read %d/%d payload bytes of %s frame: %v", e.Read, e.PayLen, e.Type, e.Err)
+}
+
 func readFrame(r io.Reader) (Frame, error) {
 	f := make(Frame, headerLen)
 	if _, err := io.ReadFull(r, f); err != nil {
 		return nil, err
 	}
 	f = append(f, make([]byte, f.PayLen())...)
-	_, err := io.ReadFull(r, f[headerLen:])
-	return f, err
+	if n, err := io.ReadFull(r, f[headerLen:]); err != nil {
+		return f, &ShortFrameError{Type: f.Type(), PayLen: f.PayLen(), Read: n, Err: err}
+	}
+	return f, nil
 }
 
 type writeError struct{ error }
@@ -160,12 +366,109 @@ func writeFrame(w io.Writer, f Frame) error {
 	return nil
 }
 
+// writePayloadFrame writes a frame of the given type which contains the given payload.
+func writePayloadFrame(w io.Writer, ft FrameType, id uint16, p []byte) error {
+	fp := getFrame(headerLen + len(p))
+	defer putFrame(fp)
+
+	f := *fp
+	setFrameHeader(f, ft, id)
+	copy(f[headerLen:], p)
+	return writeFrame(w, f)
+}
+
 func writeFwdFrame(w io.Writer, id uint16, seq ioutil.Uint16Seq, p []byte) error {
-	return writeFrame(w, MakeFrame(FwdType, id, append(seq.Encode(), p...)))
+	fp := getFrame(headerLen + 2 + len(p))
+	defer putFrame(fp)
+
+	f := *fp
+
+	setFrameHeader(f, FwdType, id)
+	binary.BigEndian.PutUint16(f[headerLen:], uint16(seq))
+	copy(f[headerLen+2:], p)
+	return writeFrame(w, f)
+}
+
+func writeAckFrame(w io.Writer, id uint16, seq []byte) error {
+	fp := getFrame(headerLen + 2)
+	defer putFrame(fp)
+
+	f := *fp
+	setFrameHeader(f, AckType, id)
+	copy(f[headerLen:], seq)
+	return writeFrame(w, f)
+}
+
+// appendAckFrame appends an ACK frame to 'b' (used for ACK frames which are held back).
+func appendAckFrame(b []byte, id uint16, seq []byte) []byte {
+	fp := getFrame(headerLen + 2)
+	defer putFrame(fp)
+
+	f := *fp
+	setFrameHeader(f, AckType, id)
+	copy(f[headerLen:], seq)
+	return append(b, f...)
+}
+
+func writeOkFrame(w io.Writer, id uint16) error {
+	fp := getFrame(headerLen)
+	defer putFrame(fp)
+
+	f := *fp
+
+	setFrameHeader(f, OkType, id)
+	return writeFrame(w, f)
 }
 
 func writeCloseFrame(w io.Writer, id uint16, reason byte) error {
-	return writeFrame(w, MakeFrame(CloseType, id, []byte{reason}))
+	fp := getFrame(headerLen + 1)
+	defer putFrame(fp)
+
+	f := *fp
+
+	setFrameHeader(f, CloseType, id)
+	f[headerLen] = reason
+	return writeFrame(w, f)
+}
+
+// writeCloseFrameWithMessage writes a CLOSE frame which carries a human-readable message after the reason byte.
+// The message is prefixed with a uint8 length, and is truncated to maxCloseMsg bytes (on a UTF-8 rune boundary).
+// Peers which are unaware of messages only read the reason byte, and ignore the rest of the payload.
+func writeCloseFrameWithMessage(w io.Writer, id uint16, reason byte, msg string) error {
+	if msg == "" {
+		return writeCloseFrame(w, id, reason)
+	}
+	if len(msg) > maxCloseMsg {
+		n := maxCloseMsg
+		for n > 0 && !utf8.RuneStart(msg[n]) {
+			n--
+		}
+		msg = msg[:n]
+	}
+
+	fp := getFrame(headerLen + 2 + len(msg))
+	defer putFrame(fp)
+
+	f := *fp
+
+	setFrameHeader(f, CloseType, id)
+	f[headerLen] = reason
+	f[headerLen+1] = byte(len(msg))
+	copy(f[headerLen+2:], msg)
+	return writeFrame(w, f)
+}
+
+// closeMessage obtains the message of a CLOSE frame's payload (empty if the frame has no message).
+// False is returned if the payload is malformed.
+func closeMessage(p []byte) (string, bool) {
+	switch {
+	case len(p) == 1:
+		return "", true
+	case len(p) < 2 || len(p) != 2+int(p[1]) || !utf8.Valid(p[2:]):
+		return "", false
+	default:
+		return string(p[2:]), true
+	}
 }
 
 func combinePKs(initPK, respPK cipher.PubKey) []byte {
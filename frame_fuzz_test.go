@@ -0,0 +1,32 @@
+//go:build go1.18
+// +build go1.18
+
+package dmsg
+
+import (
+	"testing"
+)
+
+// FuzzParseAndValidateFrame ensures that parsing arbitrary input never panics,
+// and that frames which pass validation are complete.
+// Run with: go test -run=^$ -fuzz=FuzzParseAndValidateFrame
+func FuzzParseAndValidateFrame(f *testing.F) {
+	f.Add([]byte(MakeFrame(OkType, 0, nil)))
+	f.Add([]byte(MakeFrame(RequestType, 2, []byte(`{"version":"2"}`))))
+	f.Add([]byte(MakeFrame(CloseType, 3, []byte{PlaceholderReason})))
+	f.Add([]byte(MakeFrame(FwdType, 3, []byte{0x00, 0x01, 0x02})))
+	f.Add([]byte(MakeFrame(AckType, 3, []byte{0x00, 0x01})))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		df, err := ParseAndValidateFrame(b)
+		if err != nil {
+			return
+		}
+		if df.Type != Frame(b).Type() || df.TpID != Frame(b).TpID() {
+			t.Fatalf("disassembled frame %v does not match input %v", df, b)
+		}
+		if len(b) != headerLen+Frame(b).PayLen() {
+			t.Fatalf("validated frame of length %d does not match its header", len(b))
+		}
+	})
+}
@@ -1,12 +1,18 @@
 package dmsg
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"math"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/SkycoinProject/dmsg/cipher"
 	"github.com/SkycoinProject/dmsg/ioutil"
@@ -267,9 +273,27 @@ func Test_readFrame(t *testing.T) {
 			wantErr: nil,
 		},
 		{
-			name:    "Payload shorter than required",
+			name:    "Payload missing",
 			args:    args{r: bytes.NewReader(append([]byte{0x01, 0x00, 0x02, 0x00, 0x03}))},
 			want:    Frame{0x01, 0x00, 0x02, 0x00, 0x03, 0x00, 0x00, 0x00},
+			wantErr: &ShortFrameError{Type: RequestType, PayLen: 3, Read: 0, Err: io.EOF},
+		},
+		{
+			name:    "Payload shorter than required",
+			args:    args{r: bytes.NewReader([]byte{0x01, 0x00, 0x02, 0x00, 0x03, 0x03, 0x04})},
+			want:    Frame{0x01, 0x00, 0x02, 0x00, 0x03, 0x03, 0x04, 0x00},
+			wantErr: &ShortFrameError{Type: RequestType, PayLen: 3, Read: 2, Err: io.ErrUnexpectedEOF},
+		},
+		{
+			name:    "Header shorter than required",
+			args:    args{r: bytes.NewReader([]byte{0x01, 0x00})},
+			want:    nil,
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "Empty",
+			args:    args{r: bytes.NewReader(nil)},
+			want:    nil,
 			wantErr: io.EOF,
 		},
 	}
@@ -285,6 +309,259 @@ func Test_readFrame(t *testing.T) {
 	}
 }
 
+func TestParseFrame(t *testing.T) {
+	type args struct {
+		b []byte
+	}
+
+	cases := []struct {
+		name    string
+		args    args
+		want    Frame
+		wantErr error
+	}{
+		{
+			name:    "Complete frame",
+			args:    args{b: []byte{0x01, 0x00, 0x02, 0x00, 0x03, 0x03, 0x04, 0x05}},
+			want:    Frame{0x01, 0x00, 0x02, 0x00, 0x03, 0x03, 0x04, 0x05},
+			wantErr: nil,
+		},
+		{
+			name:    "Empty payload",
+			args:    args{b: []byte{0x00, 0x00, 0x00, 0x00, 0x00}},
+			want:    Frame{0x00, 0x00, 0x00, 0x00, 0x00},
+			wantErr: nil,
+		},
+		{
+			name:    "Header too short",
+			args:    args{b: []byte{0x01, 0x00, 0x02}},
+			want:    nil,
+			wantErr: ErrFrameHeaderTooShort,
+		},
+		{
+			name:    "Payload shorter than required",
+			args:    args{b: []byte{0x01, 0x00, 0x02, 0x00, 0x03, 0x03}},
+			want:    nil,
+			wantErr: ErrFramePayloadShort,
+		},
+		{
+			name:    "Trailing bytes",
+			args:    args{b: []byte{0x01, 0x00, 0x02, 0x00, 0x03, 0x03, 0x04, 0x05, 0x06}},
+			want:    nil,
+			wantErr: ErrFrameTrailingBytes,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseFrame(tc.args.b)
+
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_unmarshalHandshakePayload(t *testing.T) {
+	initPK, _ := cipher.GenerateKeyPair()
+	respPK, _ := cipher.GenerateKeyPair()
+
+	cases := []struct {
+		name string
+		b    []byte
+		want HandshakePayload
+	}{
+		{
+			name: "With initiator's port",
+			b:    []byte(fmt.Sprintf(`{"version":"1","init_pk":"%s","resp_pk":"%s","port":2,"init_port":1}`, initPK, respPK)),
+			want: HandshakePayload{Version: "1", InitPK: initPK, RespPK: respPK, Port: 2, InitPort: 1},
+		},
+		{
+			name: "Without initiator's port (older clients)",
+			b:    []byte(fmt.Sprintf(`{"version":"1","init_pk":"%s","resp_pk":"%s","port":2}`, initPK, respPK)),
+			want: HandshakePayload{Version: "1", InitPK: initPK, RespPK: respPK, Port: 2},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := unmarshalHandshakePayload(tc.b)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestParseAndValidateFrame(t *testing.T) {
+	initPK, _ := cipher.GenerateKeyPair()
+	respPK, _ := cipher.GenerateKeyPair()
+	hs := HandshakePayload{
+		Version:  HandshakePayloadVersion,
+		InitPK:   initPK,
+		RespPK:   respPK,
+		Port:     2,
+		InitPort: 1,
+	}
+	hsBytes, err := marshalHandshakePayload(hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		b       []byte
+		want    DisassembledFrame
+		wantErr error
+	}{
+		{
+			name: "OK",
+			b:    MakeFrame(OkType, 0, nil),
+			want: DisassembledFrame{Type: OkType},
+		},
+		{
+			name: "REQUEST",
+			b:    MakeFrame(RequestType, 2, hsBytes),
+			want: DisassembledFrame{Type: RequestType, TpID: 2, Handshake: hs},
+		},
+		{
+			name: "ACCEPT",
+			b:    MakeFrame(AcceptType, 2, combinePKs(initPK, respPK)),
+			want: DisassembledFrame{Type: AcceptType, TpID: 2, InitPK: initPK, RespPK: respPK},
+		},
+		{
+			name: "CLOSE",
+			b:    MakeFrame(CloseType, 3, []byte{PortNotListeningReason}),
+			want: DisassembledFrame{Type: CloseType, TpID: 3, Reason: PortNotListeningReason},
+		},
+		{
+			name: "CLOSE with message",
+			b:    MakeFrame(CloseType, 3, []byte{PlaceholderReason, 2, 'h', 'i'}),
+			want: DisassembledFrame{Type: CloseType, TpID: 3, Reason: PlaceholderReason, Message: "hi"},
+		},
+		{
+			name: "FWD",
+			b:    MakeFrame(FwdType, 3, []byte{0x01, 0x02, 0x03}),
+			want: DisassembledFrame{Type: FwdType, TpID: 3, Seq: 0x0102, Data: []byte{0x03}},
+		},
+		{
+			name: "ACK",
+			b:    MakeFrame(AckType, 3, []byte{0x01, 0x02}),
+			want: DisassembledFrame{Type: AckType, TpID: 3, Seq: 0x0102},
+		},
+		{
+			name:    "Truncated frame",
+			b:       []byte{0x0a, 0x00, 0x03, 0x00, 0x03, 0x01},
+			wantErr: ErrFramePayloadShort,
+		},
+		{
+			name:    "Unknown frame type",
+			b:       MakeFrame(FrameType(0x7f), 3, nil),
+			wantErr: ErrUnknownFrameType,
+		},
+		{
+			name:    "OK with payload",
+			b:       MakeFrame(OkType, 0, []byte{0x01}),
+			wantErr: ErrInvalidFramePayload,
+		},
+		{
+			name:    "Malformed REQUEST",
+			b:       MakeFrame(RequestType, 2, []byte("{")),
+			wantErr: ErrInvalidFramePayload,
+		},
+		{
+			name:    "Short ACCEPT",
+			b:       MakeFrame(AcceptType, 2, initPK[:]),
+			wantErr: ErrInvalidFramePayload,
+		},
+		{
+			name:    "Empty CLOSE",
+			b:       MakeFrame(CloseType, 3, nil),
+			wantErr: ErrInvalidFramePayload,
+		},
+		{
+			name:    "CLOSE with truncated message",
+			b:       MakeFrame(CloseType, 3, []byte{PlaceholderReason, 3, 'h', 'i'}),
+			wantErr: ErrInvalidFramePayload,
+		},
+		{
+			name:    "CLOSE with invalid UTF-8 message",
+			b:       MakeFrame(CloseType, 3, []byte{PlaceholderReason, 1, 0xff}),
+			wantErr: ErrInvalidFramePayload,
+		},
+		{
+			name:    "FWD without sequence",
+			b:       MakeFrame(FwdType, 3, []byte{0x01}),
+			wantErr: ErrInvalidFramePayload,
+		},
+		{
+			name:    "ACK with trailing bytes",
+			b:       MakeFrame(AckType, 3, []byte{0x01, 0x02, 0x03}),
+			wantErr: ErrInvalidFramePayload,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseAndValidateFrame(tc.b)
+
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestFrameSplit(t *testing.T) {
+	frames := []Frame{
+		MakeFrame(RequestType, 2, []byte{0x01, 0x02, 0x03}),
+		MakeFrame(AckType, 2, []byte{0x00, 0x01}),
+		MakeFrame(CloseType, 3, nil),
+		MakeFrame(FwdType, 4, bytes.Repeat([]byte{0xff}, math.MaxUint16)),
+	}
+	var stream []byte
+	for _, f := range frames {
+		stream = append(stream, f...)
+	}
+
+	scan := func(r io.Reader) ([]Frame, error) {
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, headerLen+math.MaxUint16)
+		s.Split(FrameSplit)
+
+		var got []Frame
+		for s.Scan() {
+			got = append(got, append(Frame{}, s.Bytes()...))
+		}
+		return got, s.Err()
+	}
+
+	t.Run("Complete stream", func(t *testing.T) {
+		got, err := scan(bytes.NewReader(stream))
+		assert.NoError(t, err)
+		assert.Equal(t, frames, got)
+	})
+
+	t.Run("Partial reads", func(t *testing.T) {
+		got, err := scan(iotest.OneByteReader(bytes.NewReader(stream)))
+		assert.NoError(t, err)
+		assert.Equal(t, frames, got)
+	})
+
+	t.Run("Truncated header", func(t *testing.T) {
+		got, err := scan(bytes.NewReader(append(append([]byte{}, frames[0]...), 0x01, 0x00)))
+		assert.Equal(t, ErrFrameHeaderTooShort, err)
+		assert.Equal(t, frames[:1], got)
+	})
+
+	t.Run("Truncated payload", func(t *testing.T) {
+		got, err := scan(bytes.NewReader(stream[:len(stream)-1]))
+		assert.Equal(t, ErrFramePayloadShort, err)
+		assert.Equal(t, frames[:3], got)
+	})
+}
+
 func Test_writeFrame(t *testing.T) {
 	type args struct {
 		f Frame
@@ -318,6 +595,67 @@ func Test_writeFrame(t *testing.T) {
 	}
 }
 
+func Test_writeCloseFrameWithMessage(t *testing.T) {
+	cases := []struct {
+		name    string
+		msg     string
+		wantMsg string
+	}{
+		{name: "No message", msg: "", wantMsg: ""},
+		{name: "Message", msg: "shutting down", wantMsg: "shutting down"},
+		{name: "Truncated message", msg: strings.Repeat("a", 300), wantMsg: strings.Repeat("a", 255)},
+		{name: "Truncated on rune boundary", msg: strings.Repeat("a", 254) + "é", wantMsg: strings.Repeat("a", 254)},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, writeCloseFrameWithMessage(&buf, 3, PortNotListeningReason, tc.msg))
+
+			df, err := ParseAndValidateFrame(buf.Bytes())
+			require.NoError(t, err)
+			assert.Equal(t, PortNotListeningReason, df.Reason)
+			assert.Equal(t, tc.wantMsg, df.Message)
+		})
+	}
+}
+
+func Test_writeOkFrame(t *testing.T) {
+	cases := []struct {
+		name    string
+		id      uint16
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:    "Connection established",
+			id:      0,
+			want:    []byte{0x00, 0x00, 0x00, 0x00, 0x00},
+			wantErr: nil,
+		},
+		{
+			name:    "Example 1",
+			id:      0xABCD,
+			want:    []byte{0x00, 0xAB, 0xCD, 0x00, 0x00},
+			wantErr: nil,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+
+			err := writeOkFrame(w, tc.id)
+			assert.Equal(t, tc.wantErr, err)
+
+			got := w.Bytes()
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
 func Test_writeCloseFrame(t *testing.T) {
 	type args struct {
 		id     uint16
@@ -394,6 +732,69 @@ func Test_writeFwdFrame(t *testing.T) {
 	}
 }
 
+func Test_getFrame(t *testing.T) {
+	for _, size := range []int{headerLen, headerLen + 10, headerLen + 1, headerLen + math.MaxUint16} {
+		f := getFrame(size)
+		assert.Len(t, *f, size)
+		putFrame(f)
+	}
+}
+
+// discardWriter is an io.Writer which discards everything written to it.
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// benchWriter is an io.Writer of unknown type (as with the net.Conn of transports),
+// so that the compiler can not avoid allocating frames which are written to it.
+var benchWriter io.Writer = discardWriter{}
+
+func Benchmark_writeAckFrame(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := writeAckFrame(benchWriter, 0, ioutil.Uint16Seq(i).Encode()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := writeFrame(benchWriter, MakeFrame(AckType, 0, ioutil.Uint16Seq(i).Encode())); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func Benchmark_writeFwdFrame(b *testing.B) {
+	p := make([]byte, 1024)
+	w := new(bytes.Buffer)
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w.Reset()
+			if err := writeFwdFrame(w, 0, ioutil.Uint16Seq(i), p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w.Reset()
+			f := MakeFrame(FwdType, 0, append(ioutil.Uint16Seq(i).Encode(), p...))
+			if err := writeFrame(w, f); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func Test_combinePKs(t *testing.T) {
 	type args struct {
 		initPK string
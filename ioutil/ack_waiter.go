@@ -66,6 +66,15 @@ func (w *Uint16AckWaiter) StopAll() {
 	w.mx.Unlock()
 }
 
+// NextSeq reserves the next sequence without waiting for it to be Done.
+func (w *Uint16AckWaiter) NextSeq() Uint16Seq {
+	w.mx.Lock()
+	seq := w.nextSeq
+	w.nextSeq++
+	w.mx.Unlock()
+	return seq
+}
+
 // Wait performs the given action, and waits for given seq to be Done.
 func (w *Uint16AckWaiter) Wait(ctx context.Context, action func(seq Uint16Seq) error) (err error) {
 	ackCh := make(chan struct{}, 1)
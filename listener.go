@@ -94,6 +94,11 @@ func (l *Listener) Type() string {
 	return Type
 }
 
+// isAcceptMaxed returns whether the accept buffer is full, in which case IntroduceTransport fails.
+func (l *Listener) isAcceptMaxed() bool {
+	return len(l.accept) == cap(l.accept)
+}
+
 // IntroduceTransport handles a transport after receiving a REQUEST frame.
 func (l *Listener) IntroduceTransport(tp *Transport) error {
 	l.mx.Lock()
@@ -115,9 +120,7 @@ func (l *Listener) IntroduceTransport(tp *Transport) error {
 		return nil
 
 	default:
-		if err := tp.Close(); err != nil {
-			log.WithError(err).Warn("Failed to close transport")
-		}
+		tp.closeWithReason(ClientAcceptMaxedReason)
 		return ErrClientAcceptMaxed
 	}
 }
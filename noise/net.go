@@ -172,7 +172,7 @@ func (c *Conn) Read(b []byte) (int, error) {
 
 // Write writes to the noise-encrypted connection.
 func (c *Conn) Write(b []byte) (int, error) {
-	if len(b) > math.MaxUint16 {
+	if len(b) > math.MaxUint16-Overhead {
 		return 0, io.ErrShortWrite
 	}
 	return c.ns.Write(b)
@@ -13,6 +13,10 @@ import (
 
 var noiseLogger = logging.MustGetLogger("noise") // TODO: initialize properly or remove
 
+// Overhead is the number of bytes which encryption adds to written data (a 4-byte sequence and a 16-byte tag).
+// The result is prefixed with a uint16 length, so at most math.MaxUint16 - Overhead bytes are written at once.
+const Overhead = 4 + 16
+
 // Config hold noise parameters.
 type Config struct {
 	LocalPK   cipher.PubKey // Local instance static public key.
@@ -1,6 +1,7 @@
 package dmsg
 
 import (
+	"errors"
 	"math/rand"
 	"sync"
 	"time"
@@ -11,6 +12,16 @@ import (
 const (
 	firstEphemeralPort = 49152
 	lastEphemeralPort  = 65535
+
+	// randomPortAttempts is the number of random ephemeral ports to attempt before scanning for a free port.
+	randomPortAttempts = 32
+)
+
+// Errors related to port assignment.
+var (
+	ErrNoFreePorts       = errors.New("no free ephemeral ports")
+	ErrPortBusy          = errors.New("port is busy")
+	ErrPortQuotaExceeded = errors.New("listener quota exceeded")
 )
 
 // PortManager manages ports of nodes.
@@ -18,29 +29,86 @@ type PortManager struct {
 	mu        sync.RWMutex
 	rand      *rand.Rand
 	listeners map[uint16]*Listener
+	reserved  map[uint16]struct{} // ports used as local ports of locally-initiated transports
+
+	maxListeners int // maximum number of open listeners (0 means unlimited)
 }
 
 func newPortManager() *PortManager {
 	return &PortManager{
 		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
 		listeners: make(map[uint16]*Listener),
+		reserved:  make(map[uint16]struct{}),
 	}
 }
 
 // Listener returns a listener assigned to a given port.
+// Closed listeners are treated as absent.
 func (pm *PortManager) Listener(port uint16) (*Listener, bool) {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	l, ok := pm.listeners[port]
-	return l, ok
+	return pm.listener(port)
+}
+
+// IsListening returns whether an open listener is assigned to port.
+func (pm *PortManager) IsListening(port uint16) bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	_, ok := pm.listener(port)
+	return ok
+}
+
+// FirstFreePort returns the lowest port within [lo, hi] which is neither listened on (by an open listener) nor
+// reserved.
+// False is returned if all ports within the range are taken.
+func (pm *PortManager) FirstFreePort(lo, hi uint16) (uint16, bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	for port := int(lo); port <= int(hi); port++ {
+		if !pm.isTaken(uint16(port)) {
+			return uint16(port), true
+		}
+	}
+	return 0, false
 }
 
-// NewListener assigns listener to port if port is available.
+// NewListener assigns listener to port if port is available (a closed listener is replaced), and the listener
+// quota is not exceeded.
 func (pm *PortManager) NewListener(pk cipher.PubKey, port uint16) (*Listener, bool) {
+	l, err := pm.AddListener(pk, port)
+	return l, err == nil
+}
+
+// AddListener is NewListener, but returns ErrPortBusy if the port is not available, or
+// ErrPortQuotaExceeded if the listener quota is exceeded (see SetMaxListeners).
+func (pm *PortManager) AddListener(pk cipher.PubKey, port uint16) (*Listener, error) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	if _, ok := pm.listeners[port]; ok {
+	if pm.isTaken(port) {
+		return nil, ErrPortBusy
+	}
+	if pm.isListenersMaxed() {
+		return nil, ErrPortQuotaExceeded
+	}
+	l := newListener(pk, port)
+	pm.listeners[port] = l
+	return l, nil
+}
+
+// GetOrNewListener returns the listener assigned to port, or assigns a new listener if the port is available
+// (a closed listener is replaced). The returned bool is true only if a new listener is created.
+// A nil listener is returned if the port is reserved as the local port of a locally-initiated transport,
+// or if the listener quota is exceeded.
+func (pm *PortManager) GetOrNewListener(pk cipher.PubKey, port uint16) (*Listener, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if l, ok := pm.listener(port); ok {
+		return l, false
+	}
+	if pm.isTaken(port) || pm.isListenersMaxed() {
 		return nil, false
 	}
 	l := newListener(pk, port)
@@ -58,13 +126,90 @@ func (pm *PortManager) RemoveListener(port uint16) {
 
 // NextEmptyEphemeralPort returns next random ephemeral port.
 // It has a value between firstEphemeralPort and lastEphemeralPort.
-func (pm *PortManager) NextEmptyEphemeralPort() uint16 {
-	for {
-		port := pm.randomEphemeralPort()
-		if _, ok := pm.Listener(port); !ok {
-			return port
+// ErrNoFreePorts is returned if all ephemeral ports are taken.
+func (pm *PortManager) NextEmptyEphemeralPort() (uint16, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return pm.nextEmptyEphemeralPort()
+}
+
+// ReserveEphemeralPort reserves a random unused ephemeral port, which is to be used as the local port of a
+// locally-initiated transport. The port can not be listened on until the returned function is called to
+// release the reservation. ErrNoFreePorts is returned if all ephemeral ports are taken.
+func (pm *PortManager) ReserveEphemeralPort() (port uint16, free func(), err error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if port, err = pm.nextEmptyEphemeralPort(); err != nil {
+		return 0, nil, err
+	}
+	pm.reserved[port] = struct{}{}
+
+	var once sync.Once
+	return port, func() {
+		once.Do(func() {
+			pm.mu.Lock()
+			delete(pm.reserved, port)
+			pm.mu.Unlock()
+		})
+	}, nil
+}
+
+func (pm *PortManager) setMaxListeners(n int) {
+	pm.mu.Lock()
+	pm.maxListeners = n
+	pm.mu.Unlock()
+}
+
+// isListenersMaxed returns whether the number of open listeners has reached 'maxListeners'.
+// Closed listeners which are not yet removed do not count towards the quota.
+func (pm *PortManager) isListenersMaxed() bool {
+	if pm.maxListeners <= 0 {
+		return false
+	}
+	n := 0
+	for _, l := range pm.listeners {
+		if !l.isClosed() {
+			n++
+		}
+	}
+	return n >= pm.maxListeners
+}
+
+// listener returns the open listener assigned to port.
+// Listeners are not removed once closed, so closed listeners are treated as absent (and may be replaced).
+func (pm *PortManager) listener(port uint16) (*Listener, bool) {
+	l, ok := pm.listeners[port]
+	if !ok || l.isClosed() {
+		return nil, false
+	}
+	return l, true
+}
+
+func (pm *PortManager) isTaken(port uint16) bool {
+	_, isListening := pm.listener(port)
+	_, isReserved := pm.reserved[port]
+	return isListening || isReserved
+}
+
+func (pm *PortManager) nextEmptyEphemeralPort() (uint16, error) {
+	for i := 0; i < randomPortAttempts; i++ {
+		if port := pm.randomEphemeralPort(); !pm.isTaken(port) {
+			return port, nil
+		}
+	}
+
+	// Most ephemeral ports are taken, so scan the whole range (from a random offset).
+	const n = lastEphemeralPort - firstEphemeralPort + 1
+	offset := pm.rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := uint16(firstEphemeralPort + (offset+i)%n)
+		if !pm.isTaken(port) {
+			return port, nil
 		}
 	}
+	return 0, ErrNoFreePorts
 }
 
 func (pm *PortManager) randomEphemeralPort() uint16 {
@@ -0,0 +1,160 @@
+package dmsg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SkycoinProject/dmsg/cipher"
+)
+
+func TestPortManager_ReserveEphemeralPort(t *testing.T) {
+	pk, _ := cipher.GenerateKeyPair()
+	pm := newPortManager()
+
+	port, free, err := pm.ReserveEphemeralPort()
+	require.NoError(t, err)
+	assert.True(t, port >= firstEphemeralPort && port <= lastEphemeralPort)
+
+	// reserved port can not be listened on.
+	_, ok := pm.NewListener(pk, port)
+	assert.False(t, ok)
+
+	// freed port can be listened on.
+	free()
+	free() // freeing multiple times is harmless.
+	l, ok := pm.NewListener(pk, port)
+	require.True(t, ok)
+	assert.Equal(t, Addr{PK: pk, Port: port}, l.Addr())
+}
+
+func TestPortManager_GetOrNewListener(t *testing.T) {
+	pk, _ := cipher.GenerateKeyPair()
+	pm := newPortManager()
+
+	l1, ok := pm.GetOrNewListener(pk, port)
+	require.True(t, ok)
+	require.NotNil(t, l1)
+
+	// existing listener is returned.
+	l2, ok := pm.GetOrNewListener(pk, port)
+	assert.False(t, ok)
+	assert.Equal(t, l1, l2)
+
+	// reserved port is not listened on.
+	rPort, free, err := pm.ReserveEphemeralPort()
+	require.NoError(t, err)
+	defer free()
+	l3, ok := pm.GetOrNewListener(pk, rPort)
+	assert.False(t, ok)
+	assert.Nil(t, l3)
+
+	// closed listener is replaced.
+	require.NoError(t, l1.Close())
+	_, ok = pm.Listener(port)
+	assert.False(t, ok)
+	l4, ok := pm.GetOrNewListener(pk, port)
+	assert.True(t, ok)
+	assert.NotEqual(t, l1, l4)
+	assert.False(t, l4.isClosed())
+}
+
+func TestPortManager_NextEmptyEphemeralPort(t *testing.T) {
+	pm := newPortManager()
+
+	// all ephemeral ports but one are taken.
+	for port := firstEphemeralPort; port < lastEphemeralPort; port++ {
+		pm.reserved[uint16(port)] = struct{}{}
+	}
+	port, err := pm.NextEmptyEphemeralPort()
+	require.NoError(t, err)
+	assert.Equal(t, uint16(lastEphemeralPort), port)
+
+	// all ephemeral ports are taken.
+	_, free, err := pm.ReserveEphemeralPort()
+	require.NoError(t, err)
+	_, err = pm.NextEmptyEphemeralPort()
+	assert.Equal(t, ErrNoFreePorts, err)
+	_, _, err = pm.ReserveEphemeralPort()
+	assert.Equal(t, ErrNoFreePorts, err)
+
+	free()
+	_, err = pm.NextEmptyEphemeralPort()
+	assert.NoError(t, err)
+}
+
+func TestPortManager_IsListening(t *testing.T) {
+	pk, _ := cipher.GenerateKeyPair()
+	pm := newPortManager()
+
+	assert.False(t, pm.IsListening(port))
+	l, ok := pm.NewListener(pk, port)
+	require.True(t, ok)
+	assert.True(t, pm.IsListening(port))
+
+	require.NoError(t, l.Close())
+	assert.False(t, pm.IsListening(port))
+
+	_, ok = pm.NewListener(pk, port)
+	require.True(t, ok)
+	pm.RemoveListener(port)
+	assert.False(t, pm.IsListening(port))
+}
+
+func TestPortManager_FirstFreePort(t *testing.T) {
+	pk, _ := cipher.GenerateKeyPair()
+	pm := newPortManager()
+
+	_, ok := pm.NewListener(pk, 10)
+	require.True(t, ok)
+	pm.reserved[11] = struct{}{}
+	closed, ok := pm.NewListener(pk, 5)
+	require.True(t, ok)
+	require.NoError(t, closed.Close())
+
+	cases := []struct {
+		name     string
+		lo, hi   uint16
+		wantPort uint16
+		wantOK   bool
+	}{
+		{name: "First port free", lo: 5, hi: 20, wantPort: 5, wantOK: true},
+		{name: "Skips taken ports", lo: 10, hi: 20, wantPort: 12, wantOK: true},
+		{name: "All ports taken", lo: 10, hi: 11, wantPort: 0, wantOK: false},
+		{name: "Empty range", lo: 20, hi: 10, wantPort: 0, wantOK: false},
+		{name: "Upper bound", lo: 65535, hi: 65535, wantPort: 65535, wantOK: true},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			port, ok := pm.FirstFreePort(tc.lo, tc.hi)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantPort, port)
+		})
+	}
+}
+
+func TestPortManager_setMaxListeners(t *testing.T) {
+	pk, _ := cipher.GenerateKeyPair()
+	pm := newPortManager()
+	pm.setMaxListeners(2)
+
+	l1, err := pm.AddListener(pk, 1)
+	require.NoError(t, err)
+	_, err = pm.AddListener(pk, 2)
+	require.NoError(t, err)
+
+	_, err = pm.AddListener(pk, 1)
+	assert.Equal(t, ErrPortBusy, err)
+	_, err = pm.AddListener(pk, 3)
+	assert.Equal(t, ErrPortQuotaExceeded, err)
+	l, ok := pm.GetOrNewListener(pk, 3)
+	assert.False(t, ok)
+	assert.Nil(t, l)
+
+	// closed listeners do not count towards the quota.
+	require.NoError(t, l1.Close())
+	_, err = pm.AddListener(pk, 3)
+	assert.NoError(t, err)
+}
@@ -19,6 +19,10 @@ import (
 // ErrListenerAlreadyWrappedToNoise occurs when the provided net.Listener is already wrapped with noise.Listener
 var ErrListenerAlreadyWrappedToNoise = errors.New("listener is already wrapped to *noise.Listener")
 
+// ErrServerConnsMaxed occurs when a dms_server refuses a connection as it has reached its maximum number of
+// connections. The dms_client should connect to another dms_server.
+var ErrServerConnsMaxed = errors.New("server connections maxed")
+
 // NextConn provides information on the next connection.
 type NextConn struct {
 	conn *ServerConn
@@ -26,7 +30,7 @@ type NextConn struct {
 }
 
 func (r *NextConn) writeFrame(ft FrameType, p []byte) error {
-	if err := writeFrame(r.conn.Conn, MakeFrame(ft, r.id, p)); err != nil {
+	if err := writePayloadFrame(r.conn.Conn, ft, r.id, p); err != nil {
 		go func() {
 			if err := r.conn.Close(); err != nil {
 				log.WithError(err).Warn("Failed to close connection")
@@ -192,6 +196,19 @@ func (c *ServerConn) Serve(ctx context.Context, getConn getConnFunc) (err error)
 			}
 
 		default:
+			// Frames of unknown types are forwarded on established transports, so that newer clients
+			// can use them before the server is upgraded.
+			if _, ok := c.getNext(id); ok && !ft.IsKnown() {
+				if _, why, ok := c.forwardFrame(ft, id, p); !ok {
+					log.Debugln("FrameRejected: Failed to forward to dstClient.")
+					if err := c.delChan(id, why); err != nil {
+						return err
+					}
+					continue
+				}
+				log.Debugln("FrameForwarded")
+				continue
+			}
 			log.Debugln("FrameRejected: Unknown frame type.")
 			// Unknown frame type.
 			return errors.New("unknown frame of type received")
@@ -208,7 +225,7 @@ func (c *ServerConn) delChan(id uint16, why byte) error {
 }
 
 func (c *ServerConn) writeOK() error {
-	if err := writeFrame(c.Conn, MakeFrame(OkType, 0, nil)); err != nil {
+	if err := writeOkFrame(c.Conn, 0); err != nil {
 		return err
 	}
 	return nil
@@ -263,7 +280,9 @@ type Server struct {
 	addr  string
 	lis   net.Listener
 	conns map[cipher.PubKey]*ServerConn
-	mx    sync.RWMutex
+	mx    sync.RWMutex // protects 'conns' and 'maxConns'
+
+	maxConns int // maximum number of connections with dms_clients (0 means no limit)
 
 	wg sync.WaitGroup
 
@@ -302,6 +321,21 @@ func (s *Server) Addr() string {
 	return s.addr
 }
 
+// SetMaxConns sets the maximum number of connections with dms_clients. Further connections are refused with
+// ServerConnsMaxedReason. A limit of 0 (the default) means no limit.
+func (s *Server) SetMaxConns(n int) {
+	s.mx.Lock()
+	s.maxConns = n
+	s.mx.Unlock()
+}
+
+func (s *Server) isConnsMaxed() bool {
+	s.mx.RLock()
+	maxed := s.maxConns > 0 && len(s.conns) >= s.maxConns
+	s.mx.RUnlock()
+	return maxed
+}
+
 func (s *Server) setConn(l *ServerConn) {
 	s.mx.Lock()
 	s.conns[l.remoteClient] = l
@@ -385,6 +419,10 @@ func (s *Server) Serve() error {
 			return err
 		}
 		s.log.Infof("newConn: %v", rawConn.RemoteAddr())
+		if s.isConnsMaxed() {
+			s.rejectConn(rawConn)
+			continue
+		}
 		conn := NewServerConn(s.log, rawConn, rawConn.RemoteAddr().(*noise.Addr).PK)
 		s.setConn(conn)
 
@@ -398,6 +436,17 @@ func (s *Server) Serve() error {
 	}
 }
 
+// rejectConn informs the dms_client that the connection is refused (in place of the OK frame) and closes it.
+func (s *Server) rejectConn(conn net.Conn) {
+	s.log.Warnf("rejectedConn: %v: %s", conn.RemoteAddr(), ErrServerConnsMaxed)
+	if err := writeCloseFrame(conn, 0, ServerConnsMaxedReason); err != nil {
+		s.log.WithError(err).Warn("Failed to write frame")
+	}
+	if err := conn.Close(); err != nil {
+		s.log.WithError(err).Warn("Failed to close connection")
+	}
+}
+
 func (s *Server) updateDiscEntry(ctx context.Context) error {
 	entry, err := s.dc.Entry(ctx, s.pk)
 	if err != nil {
@@ -232,6 +232,14 @@ func TestServer_Serve(t *testing.T) {
 		testServerDisconnection(t)
 	})
 
+	t.Run("Connections beyond maximum are refused", func(t *testing.T) {
+		testServerMaxConns(t)
+	})
+
+	t.Run("Unknown frames are forwarded on established transports", func(t *testing.T) {
+		testServerUnknownFrames(t)
+	})
+
 	t.Run("Reconnection to server succeeds", func(t *testing.T) {
 		t.Parallel()
 
@@ -245,6 +253,61 @@ func TestServer_Serve(t *testing.T) {
 	})
 }
 
+func testServerMaxConns(t *testing.T) {
+	dc := disc.NewMock()
+	srv, srvErrCh, err := createServer(dc)
+	require.NoError(t, err)
+	srv.SetMaxConns(1)
+
+	responder := createClient(t, dc, responderName)
+	checkConnCount(t, smallDelay, 1, srv)
+
+	pk, sk := cipher.GenerateKeyPair()
+	initiator := NewClient(pk, sk, dc, SetLogger(logging.MustGetLogger(initiatorName)))
+	_, err = initiator.findOrConnectToServer(context.TODO(), srv.pk)
+	assert.Equal(t, ErrServerConnsMaxed, err)
+	checkConnCount(t, noDelay, 1, srv)
+
+	require.NoError(t, closeClosers(initiator, responder))
+	require.NoError(t, srv.Close())
+	require.NoError(t, errWithTimeout(srvErrCh))
+}
+
+func testServerUnknownFrames(t *testing.T) {
+	t.Parallel()
+
+	dc := disc.NewMock()
+	srv, srvErrCh, err := createServer(dc)
+	require.NoError(t, err)
+
+	unknownCh := make(chan Frame, 1)
+	pk, sk := cipher.GenerateKeyPair()
+	responder := NewClient(pk, sk, dc, SetLogger(logging.MustGetLogger(responderName)),
+		SetUnknownFrameHandler(func(_ *Transport, f Frame) error {
+			unknownCh <- f
+			return nil
+		}))
+	require.NoError(t, responder.InitiateServerConnections(context.Background(), 1))
+	initiator := createClient(t, dc, initiatorName)
+	initConn, respConn := dial(t, initiator, responder, port, noDelay)
+
+	initTp := initConn.(*Transport)
+	require.NoError(t, writeFrame(initTp.Conn, MakeFrame(FrameType(0xff), initTp.id, []byte{1, 2})))
+
+	select {
+	case f := <-unknownCh:
+		assert.Equal(t, FrameType(0xff), f.Type())
+		assert.Equal(t, []byte{1, 2}, f.Pay())
+	case <-time.After(time.Second):
+		t.Fatal("unknown frame is not forwarded")
+	}
+	testTransportMessaging(t, initConn, respConn)
+
+	require.NoError(t, closeClosers(initiator, responder))
+	require.NoError(t, srv.Close())
+	require.NoError(t, errWithTimeout(srvErrCh))
+}
+
 func testServerDisconnection(t *testing.T) {
 	t.Parallel()
 
@@ -387,8 +450,8 @@ func testServerFailedAccepts(t *testing.T) {
 			break
 		}
 	}
-	// must be error
-	require.Error(t, err)
+	// must be error, as initiator is not listening on port
+	require.Equal(t, ErrPortNotListening, err)
 	// the same as above, connection is created by another client
 	for {
 		ctx := context.Background()
@@ -396,8 +459,8 @@ func testServerFailedAccepts(t *testing.T) {
 			break
 		}
 	}
-	// must be error
-	require.Error(t, err)
+	// must be error, as responder's accept buffer is maxed
+	require.Equal(t, ErrClientAcceptMaxed, err)
 	// wait more time to ensure that the initially created connection works
 	time.Sleep(smallDelay)
 	require.NoError(t, closeClosers(responderConn, initiatorConn))
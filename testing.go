@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/SkycoinProject/skycoin/src/util/logging"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -97,6 +98,33 @@ func isReadChanOpen(ch <-chan Frame) bool {
 	}
 }
 
+// readFrames reads frames from 'r' into the returned chan, which is closed once reading fails.
+func readFrames(r io.Reader) <-chan Frame {
+	ch := make(chan Frame, 16)
+	go func() {
+		defer close(ch)
+		for {
+			f, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			ch <- f
+		}
+	}()
+	return ch
+}
+
+// newPipeTransport creates a transport which writes to one end of a pipe. Frames written by the transport
+// are read into the returned chan. The returned func closes both the transport and the pipe.
+func newPipeTransport(t *testing.T) (tp *Transport, frames <-chan Frame, closeFn func()) {
+	p1, p2 := net.Pipe()
+	tp = NewTransport(p1, logging.MustGetLogger("dmsg_test"), Addr{}, Addr{}, 0, func(id uint16) {})
+	return tp, readFrames(p2), func() {
+		require.NoError(t, tp.Close())
+		require.NoError(t, p2.Close())
+	}
+}
+
 func errWithTimeout(ch <-chan error) error {
 	select {
 	case err := <-ch:
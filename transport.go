@@ -7,6 +7,8 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/SkycoinProject/skycoin/src/util/logging"
 
@@ -20,11 +22,39 @@ var (
 	ErrRequestCheckFailed = errors.New("failed to create transport: request check failed")
 	ErrAcceptCheckFailed  = errors.New("failed to create transport: accept check failed")
 	ErrPortNotListening   = errors.New("failed to create transport: port not listening")
+	ErrRemoteTpsMaxed     = errors.New("failed to create transport: too many transports from remote")
 )
 
+// ErrDialResponseTimeout occurs when the remote does not respond to a REQUEST frame within TransportAcceptTimeout.
+var ErrDialResponseTimeout = errors.New("failed to create transport: timed out awaiting response")
+
+// ErrWriteBufferFull occurs when a write would exceed the transport's write buffer limit.
+var ErrWriteBufferFull = errors.New("transport write buffer is full")
+
+// ErrUnknownFrameType occurs when a frame of an unknown type is received for a transport.
+var ErrUnknownFrameType = errors.New("transport received frame of unknown type")
+
+// UnknownFrameHandler handles a frame of an unknown type which is received for a transport.
+// If an error is returned, the transport is closed with UnknownFrameTypeReason.
+type UnknownFrameHandler func(tp *Transport, f Frame) error
+
+// IgnoreUnknownFrames is an UnknownFrameHandler which skips frames of unknown types.
+// As servers forward frames of unknown types on established transports, this allows rolling upgrades,
+// where newer peers may send frame types that older peers can safely skip.
+func IgnoreUnknownFrames(*Transport, Frame) error { return nil }
+
+// RejectUnknownFrames is an UnknownFrameHandler which closes the transport on frames of unknown types.
+// This is the default.
+func RejectUnknownFrames(*Transport, Frame) error { return ErrUnknownFrameType }
+
+// ErrTransportNotFound occurs when no open transport matches the given remote address.
+var ErrTransportNotFound = errors.New("transport not found")
+
 // Transport represents communication between two nodes via a single hop:
 // a connection from dmsg.Client to remote dmsg.Client (via dmsg.Server intermediary).
 type Transport struct {
+	lastActivity int64 // unix nano time of the last FWD frame sent or received (first field, for 64-bit aligned atomic access)
+
 	net.Conn // underlying connection to dmsg.Server
 	log      *logging.Logger
 
@@ -41,8 +71,28 @@ type Transport struct {
 	bufCh     chan struct{}          // chan for indicating whether this is a new FWD frame
 	bufSize   int                    // keeps track of the total size of 'buf'
 	bufMx     sync.Mutex             // protects fields responsible for handling FWD and ACK frames
+	bufNotify func(delta int) bool   // notified of changes to 'bufSize' (if set), returns whether ACKs should be held back
+	bufDone   bool                   // whether 'bufNotify' is no longer notified (as transport is closed)
 	rMx       sync.Mutex             // TODO: (WORKAROUND) concurrent reads seem problematic right now.
 
+	wBufSize  int           // total size of written FWD payloads which are awaiting ACK frames
+	wBufMax   int           // high-water mark of 'wBufSize' (0 means no limit)
+	wBufBlock bool          // whether writes exceeding 'wBufMax' should block (rather than fail)
+	wBufCh    chan struct{} // chan for indicating that 'wBufSize' has decreased
+	wBufMx    sync.Mutex    // protects write buffer fields
+
+	cEnabled bool        // whether small writes are coalesced (see SetNoDelay)
+	cBuf     []byte      // coalesced data which is not yet written
+	cTimer   *time.Timer // flushes 'cBuf' once TransportCoalesceDelay passes
+	cMx      sync.Mutex  // protects coalescing fields
+
+	linger       time.Duration // how long closing waits for coalesced data to be written (see SetLinger)
+	closeTimeout time.Duration // how long closing waits for the CLOSE frame to be written (TransportCloseTimeout)
+	accTimeout   time.Duration // how long ReadAccept waits for the remote's response (TransportAcceptTimeout)
+
+	unknownFrame UnknownFrameHandler // handles frames of unknown types (RejectUnknownFrames if nil)
+	closeMsg     atomic.Value        // message of the CLOSE frame received from the remote (string)
+
 	serving     chan struct{}   // chan which closes when serving begins
 	servingOnce sync.Once       // ensures 'serving' only closes once
 	done        chan struct{}   // chan which closes when transport stops serving
@@ -53,23 +103,28 @@ type Transport struct {
 // NewTransport creates a new dms_tp.
 func NewTransport(conn net.Conn, log *logging.Logger, local, remote Addr, id uint16, doneFunc func(id uint16)) *Transport {
 	tp := &Transport{
-		Conn:      conn,
-		log:       log,
-		id:        id,
-		local:     local,
-		remote:    remote,
-		inCh:      make(chan Frame),
-		ackWaiter: ioutil.NewUint16AckWaiter(),
-		ackBuf:    make([]byte, 0, tpAckCap),
-		buf:       make(net.Buffers, 0, tpBufFrameCap),
-		bufCh:     make(chan struct{}, 1),
-		serving:   make(chan struct{}),
-		done:      make(chan struct{}),
-		doneFunc:  doneFunc,
+		Conn:         conn,
+		log:          log,
+		id:           id,
+		local:        local,
+		remote:       remote,
+		inCh:         make(chan Frame),
+		ackWaiter:    ioutil.NewUint16AckWaiter(),
+		ackBuf:       make([]byte, 0, tpAckCap),
+		buf:          make(net.Buffers, 0, tpBufFrameCap),
+		bufCh:        make(chan struct{}, 1),
+		wBufCh:       make(chan struct{}, 1),
+		serving:      make(chan struct{}),
+		done:         make(chan struct{}),
+		doneFunc:     doneFunc,
+		linger:       -1,
+		closeTimeout: TransportCloseTimeout,
+		accTimeout:   TransportAcceptTimeout,
 	}
 	if err := tp.ackWaiter.RandSeq(); err != nil {
 		log.Fatalln("failed to set ack_waiter seq:", err)
 	}
+	tp.stampActivity()
 	return tp
 }
 
@@ -88,6 +143,14 @@ func (tp *Transport) serve() (started bool) {
 // 4. But as, under the mutexes protecting `inCh`/`bufCh`, checking `done` comes first,
 // and we know that `done` is closed before `inCh`/`bufCh`, we can guarantee that it avoids writing to closed chan.
 func (tp *Transport) close() (closed bool) {
+	if closed = tp.closeKeepID(); closed {
+		tp.doneFunc(tp.id)
+	}
+	return closed
+}
+
+// closeKeepID is close, but the tp_id is not released (via 'doneFunc') as the caller releases it.
+func (tp *Transport) closeKeepID() (closed bool) {
 	if tp == nil {
 		return false
 	}
@@ -96,10 +159,11 @@ func (tp *Transport) close() (closed bool) {
 		closed = true
 
 		close(tp.done)
-		tp.doneFunc(tp.id)
 
 		tp.bufMx.Lock()
 		close(tp.bufCh)
+		tp.notifyBufSize(-tp.bufSize)
+		tp.bufDone = true
 		tp.bufMx.Unlock()
 
 		tp.inMx.Lock()
@@ -114,12 +178,63 @@ func (tp *Transport) close() (closed bool) {
 
 // Close closes the dmsg_tp.
 func (tp *Transport) Close() error {
-	if tp.close() {
-		if err := writeCloseFrame(tp.Conn, tp.id, PlaceholderReason); err != nil {
+	tp.closeWithReason(PlaceholderReason)
+	return nil
+}
+
+// CloseWithMessage closes the transport, sending the given message to the remote within the CLOSE frame.
+// The message is intended for debugging, and is obtainable by the remote via RemoteCloseMessage.
+// Messages longer than 255 bytes are truncated.
+func (tp *Transport) CloseWithMessage(msg string) error {
+	tp.closeWithMessage(PlaceholderReason, msg)
+	return nil
+}
+
+// RemoteCloseMessage returns the message of the CLOSE frame received from the remote.
+// An empty string is returned if the remote has not closed the transport, or did not send a message.
+func (tp *Transport) RemoteCloseMessage() string {
+	msg, _ := tp.closeMsg.Load().(string)
+	return msg
+}
+
+// setRemoteCloseMessage records the message of a CLOSE frame's payload 'p' (if any).
+func (tp *Transport) setRemoteCloseMessage(p []byte) {
+	if msg, ok := closeMessage(p); ok && msg != "" {
+		tp.closeMsg.Store(msg)
+		tp.log.WithField("remoteClient", tp.remote).WithField("message", msg).Info("Remote closed transport")
+	}
+}
+
+// closeWithReason closes the transport and, if this is the first time 'close' is triggered,
+// writes a CLOSE frame with the given reason (waiting at most TransportCloseTimeout).
+func (tp *Transport) closeWithReason(reason byte) {
+	tp.closeWithMessage(reason, "")
+}
+
+// closeWithMessage is closeWithReason, but the CLOSE frame also contains the given message (if not empty).
+func (tp *Transport) closeWithMessage(reason byte, msg string) {
+	if !tp.closeKeepID() {
+		return
+	}
+
+	// The write may block on an unresponsive connection, so only wait up to TransportCloseTimeout.
+	// The tp_id is released once the write is done (rather than on timeout), so that a late CLOSE frame
+	// can not close a new transport which reuses the tp_id.
+	errCh := make(chan error, 1)
+	go func() {
+		tp.flushCoalescedOnClose()
+		err := writeCloseFrameWithMessage(tp.Conn, tp.id, reason, msg)
+		tp.doneFunc(tp.id)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
 			log.WithError(err).Warn("Failed to write frame")
 		}
+	case <-time.After(tp.closeTimeout):
+		tp.log.WithField("remoteClient", tp.remote).Warn("Timed out writing CLOSE frame: remote is not notified")
 	}
-	return nil
 }
 
 // IsClosed returns whether dms_tp is closed.
@@ -142,6 +257,20 @@ func (tp *Transport) RemotePK() cipher.PubKey {
 	return tp.remote.PK
 }
 
+// MaxPayloadSize returns the maximum size of data which is sent within a single FWD frame.
+// Callers can size writes accordingly to avoid fragmentation.
+func (tp *Transport) MaxPayloadSize() int { return maxFwdPayLen }
+
+// LastActivity returns the time at which a FWD frame was last sent or received via the transport.
+// For a transport which has not seen any traffic, the time of creation is returned.
+func (tp *Transport) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&tp.lastActivity))
+}
+
+func (tp *Transport) stampActivity() {
+	atomic.StoreInt64(&tp.lastActivity, time.Now().UnixNano())
+}
+
 // LocalAddr returns local address in from <public-key>:<port>
 func (tp *Transport) LocalAddr() net.Addr { return tp.local }
 
@@ -170,19 +299,19 @@ func (tp *Transport) HandleFrame(f Frame) error {
 }
 
 // WriteRequest writes a REQUEST frame to dmsg_server to be forwarded to associated client.
-func (tp *Transport) WriteRequest(port uint16) error {
+func (tp *Transport) WriteRequest() error {
 	payload := HandshakePayload{
-		Version: HandshakePayloadVersion,
-		InitPK:  tp.local.PK,
-		RespPK:  tp.remote.PK,
-		Port:    port,
+		Version:  HandshakePayloadVersion,
+		InitPK:   tp.local.PK,
+		RespPK:   tp.remote.PK,
+		Port:     tp.remote.Port,
+		InitPort: tp.local.Port,
 	}
 	payloadBytes, err := marshalHandshakePayload(payload)
 	if err != nil {
 		return err
 	}
-	f := MakeFrame(RequestType, tp.id, payloadBytes)
-	if err := writeFrame(tp.Conn, f); err != nil {
+	if err := writePayloadFrame(tp.Conn, RequestType, tp.id, payloadBytes); err != nil {
 		tp.log.WithError(err).Error("HandshakeFailed")
 		tp.close()
 		return err
@@ -200,8 +329,7 @@ func (tp *Transport) WriteAccept() (err error) {
 		}
 	}()
 
-	f := MakeFrame(AcceptType, tp.id, combinePKs(tp.remote.PK, tp.local.PK))
-	if err = writeFrame(tp.Conn, f); err != nil {
+	if err = writePayloadFrame(tp.Conn, AcceptType, tp.id, combinePKs(tp.remote.PK, tp.local.PK)); err != nil {
 		tp.close()
 		return err
 	}
@@ -209,6 +337,7 @@ func (tp *Transport) WriteAccept() (err error) {
 }
 
 // ReadAccept awaits for an ACCEPT frame to be read from the remote client.
+// ErrDialResponseTimeout is returned if no response arrives within TransportAcceptTimeout.
 // TODO(evanlinjin): Cleanup errors.
 func (tp *Transport) ReadAccept(ctx context.Context) (err error) {
 	defer func() {
@@ -219,6 +348,9 @@ func (tp *Transport) ReadAccept(ctx context.Context) (err error) {
 		}
 	}()
 
+	timer := time.NewTimer(tp.accTimeout)
+	defer timer.Stop()
+
 	select {
 	case <-tp.done:
 		tp.close()
@@ -230,6 +362,10 @@ func (tp *Transport) ReadAccept(ctx context.Context) (err error) {
 		}
 		return ctx.Err()
 
+	case <-timer.C:
+		tp.closeWithReason(PlaceholderReason)
+		return ErrDialResponseTimeout
+
 	case f, ok := <-tp.inCh:
 		if !ok {
 			tp.close()
@@ -244,21 +380,21 @@ func (tp *Transport) ReadAccept(ctx context.Context) (err error) {
 			// - use an even number with the intermediary dmsg_server.
 			initPK, respPK, ok := splitPKs(p)
 			if !ok || initPK != tp.local.PK || respPK != tp.remote.PK || !isInitiatorID(id) {
-				if err := tp.Close(); err != nil {
-					log.WithError(err).Warn("Failed to close transport")
-				}
+				tp.closeWithReason(AcceptCheckFailedReason)
 				return ErrAcceptCheckFailed
 			}
 			return nil
 
 		case CloseType:
+			tp.setRemoteCloseMessage(p)
 			tp.close()
-			return ErrRequestRejected
+			if len(p) == 0 {
+				return ErrRequestRejected
+			}
+			return ErrorFromCode(p[0])
 
 		default:
-			if err := tp.Close(); err != nil {
-				log.WithError(err).Warn("Failed to close transport")
-			}
+			tp.closeWithReason(AcceptCheckFailedReason)
 			return ErrAcceptCheckFailed
 		}
 	}
@@ -273,13 +409,7 @@ func (tp *Transport) Serve() {
 
 	// ensure transport closes when serving stops
 	// also write CLOSE frame if this is the first time 'close' is triggered
-	defer func() {
-		if tp.close() {
-			if err := writeCloseFrame(tp.Conn, tp.id, PlaceholderReason); err != nil {
-				log.WithError(err).Warn("Failed to write close frame")
-			}
-		}
-	}()
+	defer tp.closeWithReason(PlaceholderReason)
 
 	for {
 		select {
@@ -299,15 +429,18 @@ func (tp *Transport) Serve() {
 					return
 				}
 
+				tp.stampActivity()
 				tp.bufMx.Lock()
 
 				// Acknowledgement logic: if read buffer has free space, send ACK. If not, add to 'ackBuf'.
-				ack := MakeFrame(AckType, tp.id, p[:2])
-				if tp.bufSize += len(p[2:]); tp.bufSize > tpBufCap {
-					tp.ackBuf = append(tp.ackBuf, ack...)
+				// ACKs are also held back while the connection's buffer limit is reached (see 'bufNotify').
+				seq := p[:2]
+				full := tp.notifyBufSize(len(p[2:]))
+				if tp.bufSize += len(p[2:]); tp.bufSize > tpBufCap || full {
+					tp.ackBuf = appendAckFrame(tp.ackBuf, tp.id, seq)
 				} else {
 					go func() {
-						if err := writeFrame(tp.Conn, ack); err != nil {
+						if err := writeAckFrame(tp.Conn, tp.id, seq); err != nil {
 							tp.close()
 						}
 					}()
@@ -338,6 +471,7 @@ func (tp *Transport) Serve() {
 
 			case CloseType:
 				log.Infoln("Injected [CLOSE]: Closing transport...")
+				tp.setRemoteCloseMessage(p)
 				tp.close() // ensure there is no sending of CLOSE frame
 				return
 
@@ -349,13 +483,40 @@ func (tp *Transport) Serve() {
 				return
 
 			default:
-				tp.log.Infof("Rejected [%s]: Unexpected frame, possibly malicious server (ignored for now).", f.Type())
+				if f.Type().IsKnown() {
+					tp.log.Infof("Rejected [%s]: Unexpected frame, possibly malicious server (ignored for now).", f.Type())
+					continue
+				}
+				if err := tp.handleUnknownFrame(f); err != nil {
+					log.WithError(err).Warnf("Rejected [%s]: Closing transport...", f.Type())
+					tp.closeWithReason(UnknownFrameTypeReason)
+					return
+				}
+				log.Infof("Ignored [%s]: Unknown frame type.", f.Type())
 			}
 		}
 	}
 }
 
+func (tp *Transport) handleUnknownFrame(f Frame) error {
+	if tp.unknownFrame == nil {
+		return RejectUnknownFrames(tp, f)
+	}
+	return tp.unknownFrame(tp, f)
+}
+
+// notifyBufSize notifies 'bufNotify' of a change in the size of buffered data. 'bufMx' should be locked.
+// It returns whether ACK frames should be held back as the connection's buffer limit is reached.
+func (tp *Transport) notifyBufSize(delta int) (full bool) {
+	if tp.bufNotify != nil && !tp.bufDone {
+		return tp.bufNotify(delta)
+	}
+	return false
+}
+
 // Read implements io.Reader
+// Read only blocks when no data is buffered. Otherwise, it returns the currently buffered data
+// (which may be less than len(p)) without waiting for further FWD frames.
 // TODO(evanlinjin): read deadline.
 func (tp *Transport) Read(p []byte) (n int, err error) {
 	<-tp.serving
@@ -366,7 +527,11 @@ func (tp *Transport) Read(p []byte) (n int, err error) {
 startRead:
 	tp.bufMx.Lock()
 	n, err = tp.buf.Read(p)
-	if tp.bufSize -= n; tp.bufSize < tpBufCap && len(tp.ackBuf) > 0 {
+	full := tp.notifyBufSize(-n)
+
+	// Held back ACKs are sent once there is free space. Regardless of the connection's buffer limit, they are sent
+	// once all buffered data is read, so that a transport is never stalled by unread data of other transports.
+	if tp.bufSize -= n; tp.bufSize < tpBufCap && (!full || tp.bufSize == 0) && len(tp.ackBuf) > 0 {
 		acks := tp.ackBuf
 		tp.ackBuf = make([]byte, 0, tpAckCap)
 		go func() {
@@ -390,7 +555,67 @@ startRead:
 	goto startRead
 }
 
+// WriteBufferUsage returns the total size of written payloads which are still awaiting acknowledgement.
+func (tp *Transport) WriteBufferUsage() int {
+	tp.wBufMx.Lock()
+	n := tp.wBufSize
+	tp.wBufMx.Unlock()
+	return n
+}
+
+// SetWriteBufferLimit sets the high-water mark of the write buffer (see WriteBufferUsage).
+// When a write would exceed the limit, it either blocks until enough data is acknowledged (block == true),
+// or fails with ErrWriteBufferFull (block == false). A limit of 0 (the default) disables the high-water mark.
+// A single write is always allowed when nothing is awaiting acknowledgement, even if it exceeds the limit.
+func (tp *Transport) SetWriteBufferLimit(limit int, block bool) {
+	tp.wBufMx.Lock()
+	tp.wBufMax = limit
+	tp.wBufBlock = block
+	tp.wBufMx.Unlock()
+
+	// wake blocked writes as the limit may have increased.
+	select {
+	case tp.wBufCh <- struct{}{}:
+	default:
+	}
+}
+
+func (tp *Transport) reserveWriteBuffer(n int) error {
+	for {
+		tp.wBufMx.Lock()
+		if tp.wBufMax <= 0 || tp.wBufSize == 0 || tp.wBufSize+n <= tp.wBufMax {
+			tp.wBufSize += n
+			tp.wBufMx.Unlock()
+			return nil
+		}
+		block := tp.wBufBlock
+		tp.wBufMx.Unlock()
+
+		if !block {
+			return ErrWriteBufferFull
+		}
+		select {
+		case <-tp.done:
+			return io.ErrClosedPipe
+		case <-tp.wBufCh:
+		}
+	}
+}
+
+func (tp *Transport) releaseWriteBuffer(n int) {
+	tp.wBufMx.Lock()
+	tp.wBufSize -= n
+	tp.wBufMx.Unlock()
+
+	select {
+	case tp.wBufCh <- struct{}{}:
+	default:
+	}
+}
+
 // Write implements io.Writer
+// If coalescing is enabled (see SetNoDelay), small writes may return before the data is written,
+// in which case write errors are only reflected by the transport being closed.
 // TODO(evanlinjin): write deadline.
 func (tp *Transport) Write(p []byte) (int, error) {
 	<-tp.serving
@@ -399,11 +624,42 @@ func (tp *Transport) Write(p []byte) (int, error) {
 		return 0, io.ErrClosedPipe
 	}
 
+	tp.cMx.Lock()
+	if !tp.cEnabled && len(tp.cBuf) == 0 {
+		tp.cMx.Unlock()
+		return tp.writeFwd(p)
+	}
+	defer tp.cMx.Unlock()
+
+	if !tp.cEnabled || len(tp.cBuf)+len(p) > TransportCoalesceSize {
+		if err := tp.flushCoalescedLocked(); err != nil {
+			return 0, err
+		}
+	}
+	if !tp.cEnabled || len(p) >= TransportCoalesceSize {
+		return tp.writeFwd(p)
+	}
+
+	tp.cBuf = append(tp.cBuf, p...)
+	if tp.cTimer == nil {
+		tp.cTimer = time.AfterFunc(TransportCoalesceDelay, tp.flushCoalesced)
+	}
+	return len(p), nil
+}
+
+// writeFwd writes 'p' as a single FWD frame and waits for the associated ACK frame.
+func (tp *Transport) writeFwd(p []byte) (int, error) {
+	if err := tp.reserveWriteBuffer(len(p)); err != nil {
+		return 0, err
+	}
+	defer tp.releaseWriteBuffer(len(p))
+
 	err := tp.ackWaiter.Wait(context.Background(), func(seq ioutil.Uint16Seq) error {
 		if err := writeFwdFrame(tp.Conn, tp.id, seq, p); err != nil {
 			tp.close()
 			return err
 		}
+		tp.stampActivity()
 		return nil
 	})
 	if err != nil {
@@ -411,3 +667,119 @@ func (tp *Transport) Write(p []byte) (int, error) {
 	}
 	return len(p), nil
 }
+
+// SetNoDelay controls whether small writes are coalesced (similar to Nagle's algorithm) before being sent.
+// If 'noDelay' is false, writes smaller than TransportCoalesceSize are held back for up to
+// TransportCoalesceDelay so that they can be sent as a single FWD frame.
+// The default is true (no coalescing), which favours latency.
+func (tp *Transport) SetNoDelay(noDelay bool) {
+	tp.cMx.Lock()
+	defer tp.cMx.Unlock()
+
+	if tp.cEnabled = !noDelay; noDelay {
+		tp.logFlushErr(tp.flushCoalescedLocked())
+	}
+}
+
+// flushCoalesced is called once TransportCoalesceDelay passes. The timer may fire after the transport is closed.
+func (tp *Transport) flushCoalesced() {
+	tp.cMx.Lock()
+	defer tp.cMx.Unlock()
+
+	tp.logFlushErr(tp.flushCoalescedLocked())
+}
+
+// logFlushErr logs errors of flushCoalescedLocked. io.ErrClosedPipe is expected once the transport is closed,
+// as the remaining data is then handled by flushCoalescedOnClose.
+func (tp *Transport) logFlushErr(err error) {
+	if err != nil && err != io.ErrClosedPipe {
+		tp.log.WithError(err).Warn("Failed to flush coalesced writes")
+	}
+}
+
+func (tp *Transport) flushCoalescedLocked() error {
+	if tp.IsClosed() {
+		return io.ErrClosedPipe // remaining data is written by flushCoalescedOnClose
+	}
+	if tp.cTimer != nil {
+		tp.cTimer.Stop()
+		tp.cTimer = nil
+	}
+	if len(tp.cBuf) == 0 {
+		return nil
+	}
+	b := tp.cBuf
+	tp.cBuf = nil
+	_, err := tp.writeFwd(b)
+	return err
+}
+
+// flushCoalescedOnClose writes any coalesced data before the CLOSE frame is written.
+// As the transport is closing, it does not wait for the associated ACK frame.
+func (tp *Transport) flushCoalescedOnClose() {
+	tp.cMx.Lock()
+	if tp.cTimer != nil {
+		tp.cTimer.Stop()
+		tp.cTimer = nil
+	}
+	b := tp.cBuf
+	tp.cBuf = nil
+	linger := tp.linger
+	tp.cMx.Unlock()
+
+	if len(b) == 0 {
+		return
+	}
+	if linger == 0 {
+		tp.log.WithField("remoteClient", tp.remote).Warnf("Dropped %d bytes of coalesced writes on close", len(b))
+		return
+	}
+
+	flush := func() {
+		if err := writeFwdFrame(tp.Conn, tp.id, tp.ackWaiter.NextSeq(), b); err != nil {
+			tp.log.WithError(err).Warn("Failed to flush coalesced writes")
+		}
+	}
+	if linger < 0 {
+		flush()
+		return
+	}
+
+	// The flush is aborted if it has not started writing once 'linger' passes. A write which has started
+	// is waited on, as a partially written frame would corrupt the connection.
+	const (
+		flushPending int32 = iota
+		flushStarted
+		flushAborted
+	)
+	state := flushPending
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if atomic.CompareAndSwapInt32(&state, flushPending, flushStarted) {
+			flush()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(linger):
+		if atomic.CompareAndSwapInt32(&state, flushPending, flushAborted) {
+			tp.log.WithField("remoteClient", tp.remote).Warnf("Dropped %d bytes of coalesced writes on close: linger timed out", len(b))
+			return
+		}
+		<-done
+	}
+}
+
+// SetLinger controls how closing the transport handles coalesced data which is not yet written (see SetNoDelay),
+// similar to SO_LINGER of TCP.
+// If 'd' is negative (the default), the data is written before the CLOSE frame.
+// If 'd' is zero, the data is dropped and the CLOSE frame is written immediately.
+// If 'd' is positive, the data is dropped if it has not started being written within 'd'.
+// The CLOSE frame is only written once the data is either written or dropped.
+// In all cases, closing waits at most TransportCloseTimeout for the CLOSE frame to be written.
+func (tp *Transport) SetLinger(d time.Duration) {
+	tp.cMx.Lock()
+	tp.linger = d
+	tp.cMx.Unlock()
+}
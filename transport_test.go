@@ -3,10 +3,14 @@ package dmsg
 import (
 	"bytes"
 	"context"
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/SkycoinProject/skycoin/src/util/logging"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/SkycoinProject/dmsg/cipher"
 	"github.com/SkycoinProject/dmsg/disc"
@@ -16,6 +20,7 @@ func TestNewTransport(t *testing.T) {
 	log := logging.MustGetLogger("dmsg_test")
 	tr := NewTransport(nil, log, Addr{}, Addr{}, 0, func(id uint16) {})
 	assert.NotNil(t, tr)
+	assert.Equal(t, 65508, tr.MaxPayloadSize())
 }
 
 func BenchmarkNewTransport(b *testing.B) {
@@ -58,6 +63,308 @@ func TestTransport_close(t *testing.T) {
 	})
 }
 
+// TestTransport_Close ensures that closing a transport does not block when the CLOSE frame can not be written.
+func TestTransport_Close(t *testing.T) {
+	log := logging.MustGetLogger("dmsg_test")
+
+	p1, p2 := net.Pipe() // writes to 'p1' block as 'p2' is never read from
+	released := make(chan struct{})
+	tp := NewTransport(p1, log, Addr{}, Addr{}, 0, func(id uint16) { close(released) })
+	tp.closeTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	require.NoError(t, tp.Close())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, tp.IsClosed())
+
+	// The tp_id is kept until the pending write of the CLOSE frame fails.
+	select {
+	case <-released:
+		t.Fatal("tp_id is released while the CLOSE frame may still be written")
+	default:
+	}
+	require.NoError(t, p1.Close())
+	require.NoError(t, p2.Close())
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("tp_id is not released once the write of the CLOSE frame fails")
+	}
+}
+
+// TestTransport_CloseWithMessage ensures that the message of a CLOSE frame is obtainable by the remote.
+func TestTransport_CloseWithMessage(t *testing.T) {
+	log := logging.MustGetLogger("dmsg_test")
+
+	tp1, frames, closeFn := newPipeTransport(t)
+	defer closeFn()
+	tp2 := NewTransport(nil, log, Addr{}, Addr{}, 0, func(id uint16) {})
+	go tp2.Serve()
+
+	require.NoError(t, tp1.CloseWithMessage("going away"))
+	require.NoError(t, tp2.HandleFrame(<-frames))
+	for start := time.Now(); !tp2.IsClosed(); time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Since(start) < time.Second, "remote transport is not closed")
+	}
+	assert.Equal(t, "going away", tp2.RemoteCloseMessage())
+	assert.Equal(t, "", tp1.RemoteCloseMessage())
+}
+
+// TestTransport_ReadAccept ensures that awaiting the remote's response to a REQUEST frame is bounded by
+// TransportAcceptTimeout and by the context.
+func TestTransport_ReadAccept(t *testing.T) {
+	cases := []struct {
+		name       string
+		ctxTimeout time.Duration
+		wantErr    error
+	}{
+		{name: "Responder never replies", ctxTimeout: time.Minute, wantErr: ErrDialResponseTimeout},
+		{name: "Context cancelled", ctxTimeout: time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tp, _, closeFn := newPipeTransport(t)
+			defer closeFn()
+			tp.accTimeout = 100 * time.Millisecond
+			require.NoError(t, tp.WriteRequest())
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.ctxTimeout)
+			defer cancel()
+			assert.Equal(t, tc.wantErr, tp.ReadAccept(ctx))
+			assert.True(t, tp.IsClosed())
+		})
+	}
+}
+
+// TestTransport_SetWriteBufferLimit ensures that writes exceeding the write buffer limit
+// either fail or block until previous writes are acknowledged.
+func TestTransport_SetWriteBufferLimit(t *testing.T) {
+	tp, frames, closeFn := newPipeTransport(t)
+	defer closeFn()
+	go tp.Serve()
+
+	ack := func(f Frame) {
+		require.Equal(t, FwdType, f.Type())
+		require.NoError(t, tp.HandleFrame(MakeFrame(AckType, 0, f.Pay()[:2])))
+	}
+
+	tp.SetWriteBufferLimit(3, false)
+
+	errCh1 := make(chan error, 1)
+	go func() {
+		_, err := tp.Write([]byte{1, 2, 3})
+		errCh1 <- err
+	}()
+	f1 := <-frames
+	assert.Equal(t, 3, tp.WriteBufferUsage())
+
+	_, err := tp.Write([]byte{4})
+	assert.Equal(t, ErrWriteBufferFull, err)
+
+	tp.SetWriteBufferLimit(3, true)
+
+	errCh2 := make(chan error, 1)
+	go func() {
+		_, err := tp.Write([]byte{4})
+		errCh2 <- err
+	}()
+
+	ack(f1)
+	require.NoError(t, errWithTimeout(errCh1))
+	ack(<-frames)
+	require.NoError(t, errWithTimeout(errCh2))
+	assert.Equal(t, 0, tp.WriteBufferUsage())
+}
+
+// TestTransport_Read ensures that Read returns buffered data without waiting for
+// 'p' to be filled, when the remote writes a single byte at a time.
+func TestTransport_Read(t *testing.T) {
+	tp, _, closeFn := newPipeTransport(t)
+	defer closeFn()
+	go tp.Serve()
+
+	buf := make([]byte, 10)
+	for i, b := range []byte("hello") {
+		require.NoError(t, tp.HandleFrame(MakeFrame(FwdType, 0, []byte{0, byte(i), b})))
+
+		n, err := tp.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{b}, buf[:n])
+	}
+}
+
+func TestTransport_LastActivity(t *testing.T) {
+	tp, frames, closeFn := newPipeTransport(t)
+	defer closeFn()
+	go tp.Serve()
+	go func() {
+		for f := range frames {
+			if ft, id, p := f.Disassemble(); ft == FwdType {
+				_ = tp.HandleFrame(MakeFrame(AckType, id, p[:2])) // nolint:errcheck
+			}
+		}
+	}()
+
+	last := tp.LastActivity()
+	assert.False(t, last.IsZero())
+
+	time.Sleep(time.Millisecond)
+	require.NoError(t, tp.HandleFrame(MakeFrame(FwdType, 0, []byte{0, 0, 1})))
+	buf := make([]byte, 1)
+	_, err := tp.Read(buf)
+	require.NoError(t, err)
+	assert.True(t, tp.LastActivity().After(last), "receiving FWD frame should update last activity")
+	last = tp.LastActivity()
+
+	time.Sleep(time.Millisecond)
+	_, err = tp.Write([]byte{1})
+	require.NoError(t, err)
+	assert.True(t, tp.LastActivity().After(last), "sending FWD frame should update last activity")
+}
+
+// TestTransport_SetNoDelay ensures that small writes are coalesced into a single FWD frame when
+// coalescing is enabled, and that coalesced data is written before the CLOSE frame.
+func TestTransport_SetNoDelay(t *testing.T) {
+	tp, frames, closeFn := newPipeTransport(t)
+	defer closeFn()
+	go tp.Serve()
+
+	tp.SetNoDelay(false)
+	for _, b := range []string{"a", "b", "c"} {
+		n, err := tp.Write([]byte(b))
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+
+	f := <-frames
+	require.Equal(t, FwdType, f.Type())
+	assert.Equal(t, []byte("abc"), f.Pay()[2:])
+	require.NoError(t, tp.HandleFrame(MakeFrame(AckType, 0, f.Pay()[:2])))
+
+	_, err := tp.Write([]byte("d"))
+	require.NoError(t, err)
+	require.NoError(t, tp.Close())
+
+	f = <-frames
+	require.Equal(t, FwdType, f.Type())
+	assert.Equal(t, []byte("d"), f.Pay()[2:])
+	assert.Equal(t, CloseType, (<-frames).Type())
+}
+
+// TestTransport_SetLinger ensures that closing writes coalesced data before the CLOSE frame,
+// unless linger is zero (in which case the data is dropped).
+func TestTransport_SetLinger(t *testing.T) {
+	cases := []struct {
+		name   string
+		linger time.Duration
+		want   []FrameType
+	}{
+		{name: "Negative", linger: -1, want: []FrameType{FwdType, CloseType}},
+		{name: "Zero", linger: 0, want: []FrameType{CloseType}},
+		{name: "Positive", linger: time.Second, want: []FrameType{FwdType, CloseType}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tp, frames, closeFn := newPipeTransport(t)
+			defer closeFn()
+			go tp.Serve()
+
+			tp.SetNoDelay(false)
+			tp.SetLinger(tc.linger)
+			_, err := tp.Write([]byte("a"))
+			require.NoError(t, err)
+			require.NoError(t, tp.Close())
+
+			for _, ft := range tc.want {
+				assert.Equal(t, ft, (<-frames).Type())
+			}
+		})
+	}
+}
+
+// TestTransport_unknownFrame ensures that frames of unknown types are handled by the UnknownFrameHandler.
+func TestTransport_unknownFrame(t *testing.T) {
+	unknown := MakeFrame(FrameType(0x7f), 0, []byte{0x01})
+
+	run := func(h UnknownFrameHandler) (tp *Transport, frames <-chan Frame, closeFn func()) {
+		tp, frames, closeFn = newPipeTransport(t)
+		tp.unknownFrame = h
+		go tp.Serve()
+		require.NoError(t, tp.HandleFrame(unknown))
+		return tp, frames, closeFn
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		tp, frames, closeFn := run(nil)
+		defer closeFn()
+
+		assert.Equal(t, MakeFrame(CloseType, 0, []byte{UnknownFrameTypeReason}), <-frames)
+		assert.True(t, tp.IsClosed())
+	})
+
+	t.Run("Ignore", func(t *testing.T) {
+		tp, frames, closeFn := run(IgnoreUnknownFrames)
+		defer closeFn()
+
+		// A FWD frame is still handled after the unknown frame.
+		require.NoError(t, tp.HandleFrame(MakeFrame(FwdType, 0, []byte{0, 0, 'a'})))
+		assert.Equal(t, AckType, (<-frames).Type())
+		assert.False(t, tp.IsClosed())
+	})
+}
+
+// TestTransport_MaxPayloadSize ensures that a write of MaxPayloadSize succeeds over noise-encrypted connections.
+func TestTransport_MaxPayloadSize(t *testing.T) {
+	dc := disc.NewMock()
+	srv, srvErrCh, err := createServer(dc)
+	require.NoError(t, err)
+
+	responder := createClient(t, dc, responderName)
+	initiator := createClient(t, dc, initiatorName)
+	initTp, respTp := dial(t, initiator, responder, port, noDelay)
+
+	msg := bytes.Repeat([]byte{1}, initTp.(*Transport).MaxPayloadSize())
+	n, err := initTp.Write(msg)
+	require.NoError(t, err)
+	assert.Equal(t, len(msg), n)
+
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(respTp, buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg, buf)
+
+	require.NoError(t, closeClosers(initTp, respTp, initiator, responder))
+	require.NoError(t, srv.Close())
+	require.NoError(t, errWithTimeout(srvErrCh))
+}
+
+// TestTransport_Addr ensures that both edges of a transport report
+// the local and remote addresses exchanged within the REQUEST frame.
+func TestTransport_Addr(t *testing.T) {
+	dc := disc.NewMock()
+	srv, srvErrCh, err := createServer(dc)
+	require.NoError(t, err)
+
+	responder := createClient(t, dc, responderName)
+	initiator := createClient(t, dc, initiatorName)
+	initTp, respTp := dial(t, initiator, responder, port, noDelay)
+
+	assert.Equal(t, Addr{PK: responder.pk, Port: port}, initTp.RemoteAddr())
+	assert.Equal(t, initiator.pk, initTp.LocalAddr().(Addr).PK)
+	assert.True(t, initTp.LocalAddr().(Addr).Port >= firstEphemeralPort)
+
+	assert.Equal(t, Addr{PK: responder.pk, Port: port}, respTp.LocalAddr())
+	assert.Equal(t, initTp.LocalAddr(), respTp.RemoteAddr())
+
+	require.NoError(t, closeClosers(initTp, respTp, initiator, responder))
+	require.NoError(t, srv.Close())
+	require.NoError(t, errWithTimeout(srvErrCh))
+}
+
 func BenchmarkTransport_Read(b *testing.B) {
 	initTr, respTr, err := createBenchmarkClients()
 	if err != nil {